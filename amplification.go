@@ -0,0 +1,58 @@
+package tinydns
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	amplificationWindow    = time.Second
+	amplificationThreshold = 20
+)
+
+// rateCounter counts the queries of each client over a fixed window
+type rateCounter struct {
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+func newRateCounter() *rateCounter {
+	return &rateCounter{counts: make(map[string]int)}
+}
+
+// hit records a query from the client and returns its count in the current window
+func (c *rateCounter) hit(ip net.IP, now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.start) >= amplificationWindow {
+		c.start = now
+		c.counts = make(map[string]int)
+	}
+	c.counts[ip.String()]++
+	return c.counts[ip.String()]
+}
+
+// isAmplifiable reports whether the query type typically yields large responses
+func isAmplifiable(qtype uint16) bool {
+	return qtype == dns.TypeANY || qtype == dns.TypeTXT
+}
+
+// amplificationReply returns an empty truncated response forcing the client to
+// retry over tcp when it exceeds the rate threshold with amplifiable udp queries
+func (t *TinyDNS) amplificationReply(w dns.ResponseWriter, r *dns.Msg) *dns.Msg {
+	if !isUDP(w) {
+		return nil
+	}
+	ip := clientIP(w)
+	if ip == nil {
+		return nil
+	}
+	if t.rates.hit(ip, time.Now()) <= amplificationThreshold || !isAmplifiable(r.Question[0].Qtype) {
+		return nil
+	}
+	return truncatedReply(r)
+}
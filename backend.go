@@ -0,0 +1,82 @@
+package tinydns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultBackendTimeout bounds the backend requests when no upstream timeout is set
+const defaultBackendTimeout = 5 * time.Second
+
+// maxBackendResponse bounds the size of the backend json responses
+const maxBackendResponse = 1 << 20
+
+type backendRequest struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type backendRecord struct {
+	Type  string  `json:"type"`
+	Value string  `json:"value"`
+	TTL   *uint32 `json:"ttl"`
+}
+
+type backendResponse struct {
+	Records []backendRecord `json:"records"`
+	Rcode   string          `json:"rcode"`
+}
+
+// backendReply asks the http backend for the answer, a nil response means the name is unknown to it
+func (t *TinyDNS) backendReply(r *dns.Msg, domain string) (*dns.Msg, error) {
+	body, err := json.Marshal(backendRequest{
+		Name: strings.TrimSuffix(domain, "."),
+		Type: dns.TypeToString[r.Question[0].Qtype],
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.backendClient.Post(t.options.HTTPBackend, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	var backendResp backendResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBackendResponse)).Decode(&backendResp); err != nil {
+		return nil, err
+	}
+	if len(backendResp.Records) == 0 && backendResp.Rcode == "" {
+		return nil, nil
+	}
+
+	msg := &dns.Msg{}
+	msg.SetReply(r)
+	if backendResp.Rcode != "" {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(backendResp.Rcode)]
+		if !ok {
+			return nil, fmt.Errorf("invalid rcode %q", backendResp.Rcode)
+		}
+		msg.Rcode = rcode
+	}
+	for _, record := range backendResp.Records {
+		ttl := t.ttl(&DnsRecord{TTL: record.TTL})
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", domain, ttl, record.Type, record.Value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s record %q: %w", record.Type, record.Value, err)
+		}
+		if rr != nil {
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+	return msg, nil
+}
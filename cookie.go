@@ -0,0 +1,64 @@
+package tinydns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	clientCookieLen = 8
+	serverCookieLen = 8
+)
+
+// checkCookie validates the DNS cookie of the request (RFC 7873), returning
+// the error response to send when the cookie is malformed or stale
+func (t *TinyDNS) checkCookie(w dns.ResponseWriter, r *dns.Msg) *dns.Msg {
+	option, ok := requestOption(r, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+	if !ok {
+		return nil
+	}
+	cookie, err := hex.DecodeString(option.Cookie)
+	// the client cookie is 8 bytes, the optional server cookie 8 to 32 bytes
+	if err != nil || (len(cookie) != clientCookieLen && (len(cookie) < 16 || len(cookie) > 40)) {
+		msg := &dns.Msg{}
+		msg.SetRcode(r, dns.RcodeFormatError)
+		return msg
+	}
+	if len(cookie) == clientCookieLen {
+		return nil
+	}
+	if !hmac.Equal(cookie[clientCookieLen:], t.serverCookie(w, cookie[:clientCookieLen])) {
+		msg := &dns.Msg{}
+		msg.SetRcode(r, dns.RcodeBadCookie)
+		return msg
+	}
+	return nil
+}
+
+// setCookie answers with the client cookie followed by a fresh server cookie
+func (t *TinyDNS) setCookie(w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg) {
+	option, ok := requestOption(r, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+	if !ok {
+		return
+	}
+	cookie, err := hex.DecodeString(option.Cookie)
+	if err != nil || len(cookie) < clientCookieLen {
+		return
+	}
+	clientCookie := cookie[:clientCookieLen]
+	setResponseOption(r, msg, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(append(clientCookie, t.serverCookie(w, clientCookie)...)),
+	})
+}
+
+// serverCookie binds the client cookie and address to the server secret
+func (t *TinyDNS) serverCookie(w dns.ResponseWriter, clientCookie []byte) []byte {
+	mac := hmac.New(sha256.New, t.cookieSecret)
+	mac.Write(clientCookie)
+	mac.Write(clientIP(w))
+	return mac.Sum(nil)[:serverCookieLen]
+}
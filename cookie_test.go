@@ -0,0 +1,70 @@
+package tinydns
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCookies(t *testing.T) {
+	tdns, err := New(&Options{
+		DnsRecords: map[string]*DnsRecord{"example.com": {A: []string{"10.0.0.1"}}},
+		DNSCookies: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+
+	query := func(cookie string) *dns.Msg {
+		r := &dns.Msg{}
+		r.SetQuestion("example.com.", dns.TypeA)
+		opt := r.SetEdns0(dns.DefaultMsgSize, false).IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		w := NewTestResponseWriter()
+		tdns.ServeDNS(w, r)
+		if len(w.Msgs) != 1 {
+			t.Fatalf("expected 1 response, got %d", len(w.Msgs))
+		}
+		// extended rcodes can only be sent with an OPT record
+		if _, err := w.Msgs[0].Pack(); err != nil {
+			t.Fatalf("could not pack response: %s", err)
+		}
+		return w.Msgs[0]
+	}
+	responseCookie := func(msg *dns.Msg) string {
+		if opt := msg.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+					return cookie.Cookie
+				}
+			}
+		}
+		return ""
+	}
+
+	clientCookie := "0102030405060708"
+	msg := query(clientCookie)
+	cookie := responseCookie(msg)
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("expected an answer to a client cookie, got %s", msg)
+	}
+	if len(cookie) != 2*(clientCookieLen+serverCookieLen) || cookie[:2*clientCookieLen] != clientCookie {
+		t.Fatalf("expected the client cookie followed by a server cookie, got %q", cookie)
+	}
+
+	if msg := query(cookie); msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("expected an answer to a valid server cookie, got %s", msg)
+	}
+
+	wrong, _ := hex.DecodeString(cookie)
+	wrong[len(wrong)-1] ^= 0xff
+	if msg := query(hex.EncodeToString(wrong)); msg.Rcode != dns.RcodeBadCookie || msg.IsEdns0() == nil {
+		t.Fatalf("expected BADCOOKIE with an OPT record for a wrong server cookie, got %s", msg)
+	}
+
+	if msg := query("0102030405"); msg.Rcode != dns.RcodeFormatError {
+		t.Fatalf("expected FORMERR for a malformed cookie, got %s", msg)
+	}
+}
@@ -0,0 +1,56 @@
+package tinydns
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const ddrName = "_dns.resolver.arpa."
+
+func validateDDR(options *Options) error {
+	if options.DDR == "" {
+		return nil
+	}
+	if _, ok := dns.IsDomainName(options.DDR); !ok {
+		return errors.New("invalid ddr resolver name")
+	}
+	if _, port, err := net.SplitHostPort(options.DoHAddress); err != nil || port == "" {
+		return errors.New("ddr requires a doh listen address with a port")
+	}
+	// the h2 endpoint advertised must be served over tls
+	if options.TLSCertFile == "" || options.TLSKeyFile == "" {
+		return errors.New("ddr requires a tls certificate and key for doh")
+	}
+	return nil
+}
+
+// isDDRQuery checks for the discovery of designated resolvers (RFC 9462)
+func isDDRQuery(question dns.Question) bool {
+	return strings.EqualFold(question.Name, ddrName)
+}
+
+// ddrReply advertises the doh endpoint with a SVCB record
+func (t *TinyDNS) ddrReply(r *dns.Msg) *dns.Msg {
+	msg := dns.Msg{}
+	msg.SetReply(r)
+	if r.Question[0].Qtype != dns.TypeSVCB {
+		return &msg
+	}
+	_, portValue, _ := net.SplitHostPort(t.options.DoHAddress)
+	port, _ := strconv.ParseUint(portValue, 10, 16)
+	msg.Answer = append(msg.Answer, &dns.SVCB{
+		Hdr:      dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeSVCB, Class: dns.ClassINET, Ttl: t.ttl(&DnsRecord{})},
+		Priority: 1,
+		Target:   dns.Fqdn(t.options.DDR),
+		Value: []dns.SVCBKeyValue{
+			&dns.SVCBAlpn{Alpn: []string{"h2"}},
+			&dns.SVCBPort{Port: uint16(port)},
+			&dns.SVCBDoHPath{Template: "/dns-query{?dns}"},
+		},
+	})
+	return &msg
+}
@@ -0,0 +1,58 @@
+package tinydns
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+func parseDenyAnswerCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny answer cidr: %w", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// denyAnswers strips the address records within the networks from an upstream response,
+// when none of its addresses is left the response becomes NODATA
+func denyAnswers(msg *dns.Msg, networks []*net.IPNet) {
+	var denied, kept int
+	answers := msg.Answer[:0]
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch record := rr.(type) {
+		case *dns.A:
+			ip = record.A
+		case *dns.AAAA:
+			ip = record.AAAA
+		default:
+			answers = append(answers, rr)
+			continue
+		}
+		if containsIP(networks, ip) {
+			denied++
+			continue
+		}
+		kept++
+		answers = append(answers, rr)
+	}
+	msg.Answer = answers
+	if denied > 0 && kept == 0 {
+		msg.Answer = nil
+	}
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package tinydns
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+const dohMimeType = "application/dns-message"
+
+// ServeHTTP implements the DNS-over-HTTPS endpoint (RFC 8484)
+func (t *TinyDNS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var (
+		data []byte
+		err  error
+	)
+	switch req.Method {
+	case http.MethodGet:
+		data, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != dohMimeType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r := &dns.Msg{}
+	if err := r.Unpack(data); err != nil || len(r.Question) == 0 {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	rw := &memoryResponseWriter{}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		rw.remoteAddr = &net.TCPAddr{IP: net.ParseIP(host)}
+	}
+	t.ServeDNS(rw, r)
+	if rw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+	response, err := rw.msg.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMimeType)
+	_, _ = w.Write(response)
+}
+
+func (t *TinyDNS) newDoHServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", t)
+	return &http.Server{Addr: t.options.DoHAddress, Handler: mux}
+}
+
+func (t *TinyDNS) runDoH() {
+	t.logger.Infof("Listening on: doh:%s\n", t.options.DoHAddress)
+	var err error
+	if t.options.TLSCertFile != "" && t.options.TLSKeyFile != "" {
+		err = t.dohServer.ListenAndServeTLS(t.options.TLSCertFile, t.options.TLSKeyFile)
+	} else {
+		// plain http, for use behind a tls terminating proxy
+		err = t.dohServer.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		t.logger.Errorf("Could not run doh server: %s\n", err)
+	}
+}
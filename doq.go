@@ -0,0 +1,106 @@
+package tinydns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// doqALPN identifies DNS-over-QUIC during the tls handshake (RFC 9250)
+	doqALPN = "doq"
+	// doqStreamTimeout bounds the exchange of a query and its response on a stream
+	doqStreamTimeout = 10 * time.Second
+)
+
+// DoQ error codes closing streams and connections that can't be answered
+const (
+	doqInternalError quic.ApplicationErrorCode = 1
+	doqProtocolError quic.ApplicationErrorCode = 2
+)
+
+// doqTLSConfig loads the certificate served to DNS-over-QUIC clients
+func doqTLSConfig(options *Options) (*tls.Config, error) {
+	if options.TLSCertFile == "" || options.TLSKeyFile == "" {
+		return nil, errors.New("doq requires a tls certificate and key")
+	}
+	certificate, err := tls.LoadX509KeyPair(options.TLSCertFile, options.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}, NextProtos: []string{doqALPN}}, nil
+}
+
+// serveDoQ accepts DNS-over-QUIC connections until the listener is closed
+func (t *TinyDNS) serveDoQ(listener *quic.Listener) error {
+	for {
+		conn, err := listener.Accept(context.Background())
+		if errors.Is(err, quic.ErrServerClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go t.serveDoQConn(conn)
+	}
+}
+
+// serveDoQConn answers each query of the connection on its own stream
+func (t *TinyDNS) serveDoQConn(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			// the connection is closed
+			return
+		}
+		go t.serveDoQStream(conn, stream)
+	}
+}
+
+// serveDoQStream reads the length prefixed query of the stream and writes the response the same way
+func (t *TinyDNS) serveDoQStream(conn quic.Connection, stream quic.Stream) {
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(doqStreamTimeout))
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		stream.CancelRead(quic.StreamErrorCode(doqProtocolError))
+		return
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		stream.CancelRead(quic.StreamErrorCode(doqProtocolError))
+		return
+	}
+	r := &dns.Msg{}
+	// queries must have a zero message id, the stream identifying them
+	if err := r.Unpack(buf); err != nil || r.Id != 0 {
+		_ = conn.CloseWithError(doqProtocolError, "invalid query")
+		return
+	}
+
+	// responses are not size limited as over udp
+	rw := &memoryResponseWriter{}
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+		rw.remoteAddr = &net.TCPAddr{IP: addr.IP, Port: addr.Port}
+	}
+	t.ServeDNS(rw, r)
+	if rw.msg == nil {
+		stream.CancelWrite(quic.StreamErrorCode(doqInternalError))
+		return
+	}
+	response, err := rw.msg.Pack()
+	if err != nil {
+		t.logger.Errorf("Could not pack doq response: %s\n", err)
+		stream.CancelWrite(quic.StreamErrorCode(doqInternalError))
+		return
+	}
+	_, _ = stream.Write(binary.BigEndian.AppendUint16(nil, uint16(len(response))))
+	_, _ = stream.Write(response)
+}
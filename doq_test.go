@@ -0,0 +1,98 @@
+package tinydns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// writeSelfSignedCertificate writes a throwaway certificate for 127.0.0.1 and its key as pem files
+func writeSelfSignedCertificate(t *testing.T) (string, string) {
+	certificate := selfSignedTLSConfig(t).Certificates[0]
+	key, err := x509.MarshalECPrivateKey(certificate.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestDoQ(t *testing.T) {
+	if _, err := New(&Options{Net: "doq"}); err == nil {
+		t.Fatal("expected doq without a certificate to be rejected")
+	}
+
+	certFile, keyFile := writeSelfSignedCertificate(t)
+	tdns, err := New(&Options{
+		Net:         "doq",
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+		DnsRecords:  map[string]*DnsRecord{"example.com": {A: []string{"10.0.0.1"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+	listener, err := quic.ListenAddr("127.0.0.1:0", tdns.doqTLS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() { _ = tdns.serveDoQ(listener) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{doqALPN}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &dns.Msg{}
+	r.SetQuestion("example.com.", dns.TypeA)
+	r.Id = 0
+	query, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.Close()
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		t.Fatalf("expected a length prefixed response, got %d bytes", len(data))
+	}
+	msg := &dns.Msg{}
+	if err := msg.Unpack(data[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Fatalf("unexpected doq response: %s", msg)
+	}
+}
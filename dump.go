@@ -0,0 +1,25 @@
+package tinydns
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// DumpOptions writes the options in effect as indented json, with the defaults and
+// system resolvers applied, hooks and secrets are left out
+func (t *TinyDNS) DumpOptions(w io.Writer) error {
+	return dumpOptions(w, *t.options)
+}
+
+func dumpOptions(w io.Writer, options Options) error {
+	if options.TTL == 0 {
+		options.TTL = defaultTTL * time.Second
+	}
+	if options.AnswerOrder == "" {
+		options.AnswerOrder = AnswerOrderConfig
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(options)
+}
@@ -0,0 +1,44 @@
+package tinydns
+
+import "github.com/miekg/dns"
+
+// requestOption returns the EDNS0 option with the given code from the request
+func requestOption(r *dns.Msg, code uint16) dns.EDNS0 {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if option.Option() == code {
+			return option
+		}
+	}
+	return nil
+}
+
+// setResponseOption sets the option in the response OPT record, creating it from
+// the request one if needed and replacing any option with the same code
+func setResponseOption(r *dns.Msg, msg *dns.Msg, option dns.EDNS0) {
+	reqOpt := r.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = msg.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, existing := range opt.Option {
+		if existing.Option() != option.Option() {
+			options = append(options, existing)
+		}
+	}
+	opt.Option = append(options, option)
+}
+
+// dnssecOK reports whether the request has the DO bit set
+func dnssecOK(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
@@ -0,0 +1,42 @@
+package tinydns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// InvalidRecordError is returned by New for a configured record failing validation
+type InvalidRecordError struct {
+	Domain string
+	Err    error
+}
+
+func (e *InvalidRecordError) Error() string {
+	return fmt.Sprintf("invalid record for %s: %s", e.Domain, e.Err)
+}
+
+func (e *InvalidRecordError) Unwrap() error {
+	return e.Err
+}
+
+// BindError is returned by Run when the server can't listen on its address
+type BindError struct {
+	Net     string
+	Address string
+	Err     error
+}
+
+func (e *BindError) Error() string {
+	return fmt.Sprintf("could not listen on %s:%s: %s", e.Net, e.Address, e.Err)
+}
+
+func (e *BindError) Unwrap() error {
+	return e.Err
+}
+
+// isListenError checks whether the server failed opening its socket rather than serving
+func isListenError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "listen"
+}
@@ -0,0 +1,151 @@
+package tinydns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	execTimeout   = 5 * time.Second
+	maxExecOutput = 64 * 1024
+	// maxExecRunning bounds the commands running at once, further queries fail
+	maxExecRunning = 16
+	// maxExecCache bounds the cached command outputs
+	maxExecCache = 4096
+)
+
+// limitedBuffer keeps at most limit bytes, discarding the rest so that the command is not blocked,
+// the buffer is not embedded as its ReadFrom would be used by io.Copy, bypassing the limit
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.exceeded || b.buf.Len()+len(p) > b.limit {
+		b.exceeded = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// execRunner bounds the commands running at once and caches their output per query
+type execRunner struct {
+	slots chan struct{}
+	mu    sync.Mutex
+	cache map[execKey]execResult
+}
+
+type execKey struct {
+	command string
+	name    string
+	qtype   uint16
+}
+
+type execResult struct {
+	lines   []string
+	expires time.Time
+}
+
+func newExecRunner() *execRunner {
+	return &execRunner{
+		slots: make(chan struct{}, maxExecRunning),
+		cache: make(map[execKey]execResult),
+	}
+}
+
+// records runs the command of the record with {name} and {type} substituted, each
+// line of its output being a type and its value (eg. "A 1.2.3.4"), the output is
+// reused for the ttl of the answers
+func (e *execRunner) records(command, domain string, qtype uint16, ttl uint32) ([]dns.RR, error) {
+	name := strings.TrimSuffix(domain, ".")
+	// names become command arguments and must not be taken as flags
+	if !isExecSafeName(name) {
+		return nil, fmt.Errorf("name %q can't be passed to a command", name)
+	}
+	key := execKey{command: command, name: strings.ToLower(name), qtype: qtype}
+	e.mu.Lock()
+	result, ok := e.cache[key]
+	e.mu.Unlock()
+	if !ok || time.Now().After(result.expires) {
+		lines, err := e.run(command, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		result = execResult{lines: lines, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+		if ttl > 0 {
+			e.mu.Lock()
+			// the cache is bounded by starting over once full
+			if len(e.cache) >= maxExecCache {
+				e.cache = make(map[execKey]execResult)
+			}
+			e.cache[key] = result
+			e.mu.Unlock()
+		}
+	}
+	var rrs []dns.RR
+	for _, line := range result.lines {
+		rr, err := anyRecord(domain, ttl, line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid record %q: %w", line, err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// run executes the command when a slot is free, failing rather than queueing otherwise
+func (e *execRunner) run(command, name string, qtype uint16) ([]string, error) {
+	select {
+	case e.slots <- struct{}{}:
+		defer func() { <-e.slots }()
+	default:
+		return nil, fmt.Errorf("%d commands already running", maxExecRunning)
+	}
+	replacer := strings.NewReplacer("{name}", name, "{type}", dns.TypeToString[qtype])
+	args := strings.Fields(command)
+	for i := range args {
+		args[i] = replacer.Replace(args[i])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+	stdout := &limitedBuffer{limit: maxExecOutput}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = stdout
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	if stdout.exceeded {
+		return nil, fmt.Errorf("output exceeds %d bytes", maxExecOutput)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(&stdout.buf)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// isExecSafeName checks that the name only has hostname characters and doesn't start with a dash
+func isExecSafeName(name string) bool {
+	if name == "" || name[0] == '-' {
+		return false
+	}
+	for _, r := range name {
+		if !isAlphaNumeric(r) && r != '-' && r != '.' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package tinydns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// TestExecHelperProcess is the command run by the exec tests, answering as configured by the environment
+func TestExecHelperProcess(t *testing.T) {
+	mode := os.Getenv("TINYDNS_EXEC_HELPER")
+	if mode == "" {
+		return
+	}
+	if countFile := os.Getenv("TINYDNS_EXEC_COUNT"); countFile != "" {
+		file, err := os.OpenFile(countFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err == nil {
+			_, _ = file.WriteString("x")
+			_ = file.Close()
+		}
+	}
+	switch mode {
+	case "large":
+		fmt.Print(strings.Repeat("A 10.0.0.1\n", maxExecOutput/10))
+	default:
+		fmt.Println("A 10.0.0.1")
+	}
+	os.Exit(0)
+}
+
+// execHelper returns the command running TestExecHelperProcess in mode, and the file counting its runs
+func execHelper(t *testing.T, mode string) (string, string) {
+	countFile := filepath.Join(t.TempDir(), "count")
+	t.Setenv("TINYDNS_EXEC_HELPER", mode)
+	t.Setenv("TINYDNS_EXEC_COUNT", countFile)
+	return os.Args[0] + " -test.run=^TestExecHelperProcess$ {name}", countFile
+}
+
+func execRuns(t *testing.T, countFile string) int {
+	data, err := os.ReadFile(countFile)
+	if os.IsNotExist(err) {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return len(data)
+}
+
+func TestExecSafeName(t *testing.T) {
+	for name, safe := range map[string]bool{
+		"www.example.com":       true,
+		"_sip._tcp.example.com": true,
+		"host-1.example.com":    true,
+		"":                      false,
+		"-rf":                   false,
+		"--help.example.com":    false,
+		"a;id.example.com":      false,
+		"$(id).example.com":     false,
+		"`id`.example.com":      false,
+		"a b.example.com":       false,
+		"a/b.example.com":       false,
+		"a\\b.example.com":      false,
+	} {
+		if isExecSafeName(name) != safe {
+			t.Errorf("expected isExecSafeName(%q) to be %v", name, safe)
+		}
+	}
+
+	command, countFile := execHelper(t, "answer")
+	if _, err := newExecRunner().records(command, "-x.example.com.", dns.TypeA, 60); err == nil {
+		t.Fatal("expected a name starting with a dash to be rejected")
+	}
+	if n := execRuns(t, countFile); n != 0 {
+		t.Fatalf("expected the command not to run for an unsafe name, ran %d times", n)
+	}
+}
+
+func TestExecOutputLimit(t *testing.T) {
+	command, _ := execHelper(t, "large")
+	if _, err := newExecRunner().records(command, "example.com.", dns.TypeA, 60); err == nil {
+		t.Fatalf("expected an output over %d bytes to fail", maxExecOutput)
+	}
+}
+
+func TestExecCache(t *testing.T) {
+	command, countFile := execHelper(t, "answer")
+	runner := newExecRunner()
+	for i := 0; i < 2; i++ {
+		rrs, err := runner.records(command, "zero.example.com.", dns.TypeA, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rrs) != 1 || rrs[0].(*dns.A).A.String() != "10.0.0.1" {
+			t.Fatalf("unexpected records: %v", rrs)
+		}
+	}
+	if n := execRuns(t, countFile); n != 2 {
+		t.Fatalf("expected a zero ttl output not to be cached, ran %d times", n)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := runner.records(command, "cached.example.com.", dns.TypeA, 60); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := execRuns(t, countFile); n != 3 {
+		t.Fatalf("expected the output to be cached for the ttl, ran %d times", n)
+	}
+}
@@ -0,0 +1,36 @@
+package tinydns
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// isServerIDQuery checks for the CHAOS TXT queries identifying the server (RFC 4892)
+func isServerIDQuery(question dns.Question) bool {
+	if question.Qclass != dns.ClassCHAOS || question.Qtype != dns.TypeTXT {
+		return false
+	}
+	name := strings.ToLower(question.Name)
+	return name == "id.server." || name == "hostname.bind."
+}
+
+func (t *TinyDNS) serverIDReply(r *dns.Msg) *dns.Msg {
+	msg := dns.Msg{}
+	msg.SetReply(r)
+	msg.Authoritative = true
+	msg.Answer = append(msg.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+		Txt: []string{t.options.ServerID},
+	})
+	return &msg
+}
+
+// setNSID echoes the server identifier when the request carries the NSID option (RFC 5001)
+func setNSID(r *dns.Msg, msg *dns.Msg, nsid string) {
+	if requestOption(r, dns.EDNS0NSID) == nil {
+		return
+	}
+	setResponseOption(r, msg, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(nsid))})
+}
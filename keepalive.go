@@ -0,0 +1,22 @@
+package tinydns
+
+import (
+	"math"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// setKeepalive advertises the tcp idle timeout when the request carries the keepalive option,
+// which is never sent over udp (RFC 7828)
+func setKeepalive(w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg, timeout time.Duration) {
+	if isUDP(w) || requestOption(r, dns.EDNS0TCPKEEPALIVE) == nil {
+		return
+	}
+	// the timeout is in units of 100 milliseconds
+	units := timeout / (100 * time.Millisecond)
+	if units > math.MaxUint16 {
+		units = math.MaxUint16
+	}
+	setResponseOption(r, msg, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: uint16(units)})
+}
@@ -0,0 +1,85 @@
+package tinydns
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// maxQueryRecords bounds the records a query may carry besides its question,
+// allowing for the OPT and TSIG pseudo records
+const maxQueryRecords = 2
+
+// maxQuestions bounds the questions answered separately for a single query
+const maxQuestions = 8
+
+const (
+	MultiQuestionReject = "reject"
+	MultiQuestionAnswer = "answer"
+)
+
+func validateMultiQuestion(policy string) error {
+	switch policy {
+	case "", MultiQuestionReject, MultiQuestionAnswer:
+		return nil
+	}
+	return fmt.Errorf("invalid multi question policy %q", policy)
+}
+
+// checkQuery returns a FORMERR response for queries that are oversized or without questions,
+// so that they are rejected before any work is done, several questions are only accepted
+// when they are all answered and up to maxQuestions
+func (t *TinyDNS) checkQuery(r *dns.Msg) *dns.Msg {
+	questions := len(r.Question) == 1 ||
+		(len(r.Question) > 1 && len(r.Question) <= maxQuestions && t.options.MultiQuestion == MultiQuestionAnswer)
+	if questions && len(r.Answer)+len(r.Ns)+len(r.Extra) <= maxQueryRecords &&
+		(t.options.MaxQuerySize <= 0 || r.Len() <= t.options.MaxQuerySize) {
+		return nil
+	}
+	msg := &dns.Msg{}
+	msg.SetRcode(r, dns.RcodeFormatError)
+	// the questions are not echoed back
+	msg.Question = nil
+	return msg
+}
+
+// acceptMultiQuestion lets queries with several questions reach the handler,
+// the other header checks are left to the default accept func
+func acceptMultiQuestion(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Qdcount > 1 {
+		dh.Qdcount = 1
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// answerQuestions answers each question separately under the id of the query, merging
+// the responses with the rcode of the first failing one
+func (t *TinyDNS) answerQuestions(w dns.ResponseWriter, r *dns.Msg, id string) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetReply(r)
+	msg.Question = r.Question
+	for _, question := range r.Question {
+		single := r.Copy()
+		single.Question = []dns.Question{question}
+		rw := &memoryResponseWriter{remoteAddr: w.RemoteAddr()}
+		t.serveDNS(rw, single, id)
+		if rw.msg == nil {
+			continue
+		}
+		if msg.Rcode == dns.RcodeSuccess {
+			msg.Rcode = rw.msg.Rcode
+		}
+		msg.Authoritative = rw.msg.Authoritative
+		msg.Answer = append(msg.Answer, rw.msg.Answer...)
+		msg.Ns = append(msg.Ns, rw.msg.Ns...)
+		for _, rr := range rw.msg.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				msg.Extra = append(msg.Extra, rr)
+			}
+		}
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		msg.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return msg
+}
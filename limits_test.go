@@ -0,0 +1,43 @@
+package tinydns
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMultiQuestion(t *testing.T) {
+	tdns, err := New(&Options{
+		DnsRecords:    map[string]*DnsRecord{"a.example.com": {A: []string{"10.0.0.1"}}, "b.example.com": {A: []string{"10.0.0.2"}}},
+		MultiQuestion: MultiQuestionAnswer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+	ids := make(map[string]struct{})
+	tdns.OnServeDns = func(info Info) { ids[info.ID] = struct{}{} }
+
+	r := &dns.Msg{}
+	r.SetQuestion("a.example.com.", dns.TypeA)
+	r.Question = append(r.Question, dns.Question{Name: "b.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	w := NewTestResponseWriter()
+	tdns.ServeDNS(w, r)
+	if len(w.Msgs) != 1 || len(w.Msgs[0].Answer) != 2 {
+		t.Fatalf("expected both questions answered, got %v", w.Msgs)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("expected the questions to share the query id, got %v", ids)
+	}
+
+	r.Question = nil
+	for i := 0; i <= maxQuestions; i++ {
+		r.Question = append(r.Question, dns.Question{Name: fmt.Sprintf("%d.example.com.", i), Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	}
+	w = NewTestResponseWriter()
+	tdns.ServeDNS(w, r)
+	if len(w.Msgs) != 1 || w.Msgs[0].Rcode != dns.RcodeFormatError {
+		t.Fatalf("expected FORMERR above %d questions, got %v", maxQuestions, w.Msgs)
+	}
+}
@@ -0,0 +1,21 @@
+package tinydns
+
+import "github.com/projectdiscovery/gologger"
+
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// DefaultLogger writes through gologger and is used when Options.Logger is nil
+var DefaultLogger Logger = &gologgerLogger{}
+
+type gologgerLogger struct{}
+
+func (l *gologgerLogger) Infof(format string, args ...interface{}) {
+	gologger.Info().Msgf(format, args...)
+}
+
+func (l *gologgerLogger) Errorf(format string, args ...interface{}) {
+	gologger.Error().Msgf(format, args...)
+}
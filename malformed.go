@@ -0,0 +1,45 @@
+package tinydns
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// malformed question modes, for testing whether clients validate the echoed question
+const (
+	MalformedQuestionName = "name"
+	MalformedQuestionType = "type"
+	MalformedQuestionDrop = "drop"
+)
+
+func validateMalformedQuestion(mode string) error {
+	switch mode {
+	case "", MalformedQuestionName, MalformedQuestionType, MalformedQuestionDrop:
+		return nil
+	}
+	return fmt.Errorf("invalid malformed question mode %q", mode)
+}
+
+// malformQuestion replaces the echoed question with one not matching the query,
+// the question slice may be shared with the query and is never modified in place
+func malformQuestion(msg *dns.Msg, mode string) {
+	if len(msg.Question) == 0 {
+		return
+	}
+	question := msg.Question[0]
+	switch mode {
+	case MalformedQuestionName:
+		question.Name = "malformed." + question.Name
+	case MalformedQuestionType:
+		if question.Qtype == dns.TypeA {
+			question.Qtype = dns.TypeAAAA
+		} else {
+			question.Qtype = dns.TypeA
+		}
+	case MalformedQuestionDrop:
+		msg.Question = nil
+		return
+	}
+	msg.Question = []dns.Question{question}
+}
@@ -2,15 +2,64 @@ package tinydns
 
 import (
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 type Options struct {
-	ListenAddress   string
-	Net             string
-	UpstreamServers []string
-	DnsRecords      map[string]*DnsRecord
-	DiskCache       bool
-	TTL             time.Duration
+	ListenAddress           string
+	Net                     string
+	Interface               string
+	ReusePort               bool
+	TCPKeepalive            time.Duration
+	UpstreamServers         []string
+	UseSystemResolvers      bool
+	UpstreamTimeout         time.Duration
+	ProxyAddress            string
+	UpstreamSourceIP        string
+	HTTPBackend             string
+	ReverseUpstreamServers  []string
+	ShadowUpstream          string
+	DenyAnswerCIDRs         []string
+	DnsRecords              map[string]*DnsRecord
+	DiskCache               bool
+	CacheDir                string
+	CacheSnapshotFile       string
+	CacheSnapshotInterval   time.Duration
+	TTL                     time.Duration
+	TTLJitter               int
+	StaleRevalidateWindow   time.Duration
+	Compress                bool
+	MaxUDPSize              int
+	Logger                  Logger `json:"-"`
+	FlattenCNAME            bool
+	SPFAdditional           bool
+	OfflineMode             bool
+	RecordMode              bool
+	ReplayFile              string
+	ServerID                string
+	NSID                    string
+	DoHAddress              string
+	DDR                     string
+	TLSCertFile             string
+	TLSKeyFile              string
+	BeforeForward           func(*dns.Msg) *dns.Msg                      `json:"-"`
+	AfterResolve            func(req, resp *dns.Msg, info Info) *dns.Msg `json:"-"`
+	DNSCookies              bool
+	AnswerOrder             string
+	MaxAnswers              int
+	MaxQuerySize            int
+	MultiQuestion           string
+	MalformedQuestion       string
+	ResponseDelays          map[string]time.Duration
+	AmplificationProtection bool
+	AuthoritativeZones      []string
+	ApexHTTPS               bool
+	CatchAllCNAME           string
+	ZoneDir                 string
+	ReverseZones            []ReverseZone
+	SyntheticZone           *SyntheticZone
+	CookieSecret            []byte `json:"-"`
 }
 
 var DefaultOptions = Options{
@@ -18,4 +67,5 @@ var DefaultOptions = Options{
 	Net:             "udp",
 	UpstreamServers: []string{"8.8.8.8"},
 	DiskCache:       true,
+	Compress:        true,
 }
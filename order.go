@@ -0,0 +1,51 @@
+package tinydns
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	AnswerOrderConfig     = "config"
+	AnswerOrderRandom     = "random"
+	AnswerOrderClientHash = "clienthash"
+)
+
+func validateAnswerOrder(order string) error {
+	switch order {
+	case "", AnswerOrderConfig, AnswerOrderRandom, AnswerOrderClientHash:
+		return nil
+	}
+	return fmt.Errorf("invalid answer order %q", order)
+}
+
+// orderAnswers permutes the A and AAAA answers in place, leaving the other records untouched
+func orderAnswers(answers []dns.RR, order string, ip net.IP) {
+	var rnd *rand.Rand
+	switch order {
+	case AnswerOrderRandom:
+		rnd = rand.New(rand.NewSource(rand.Int63()))
+	case AnswerOrderClientHash:
+		// the same client always gets the same permutation
+		hash := fnv.New64a()
+		hash.Write(ip)
+		rnd = rand.New(rand.NewSource(int64(hash.Sum64())))
+	default:
+		return
+	}
+	for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var indexes []int
+		for i, rr := range answers {
+			if rr.Header().Rrtype == rrtype {
+				indexes = append(indexes, i)
+			}
+		}
+		rnd.Shuffle(len(indexes), func(i, j int) {
+			answers[indexes[i]], answers[indexes[j]] = answers[indexes[j]], answers[indexes[i]]
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package tinydns
+
+import (
+	"github.com/miekg/dns"
+)
+
+const maxIdleConns = 4
+
+// connPool keeps established tcp and tcp-tls connections to an upstream for reuse
+type connPool struct {
+	client *dns.Client
+	dial   func() (*dns.Conn, error)
+	conns  chan *dns.Conn
+}
+
+func newConnPool(client *dns.Client, address string) *connPool {
+	return &connPool{
+		client: client,
+		dial: func() (*dns.Conn, error) {
+			return client.Dial(address)
+		},
+		conns: make(chan *dns.Conn, maxIdleConns),
+	}
+}
+
+func (p *connPool) get() (conn *dns.Conn, reused bool, err error) {
+	select {
+	case conn := <-p.conns:
+		return conn, true, nil
+	default:
+		conn, err := p.dial()
+		return conn, false, err
+	}
+}
+
+func (p *connPool) put(conn *dns.Conn) {
+	select {
+	case p.conns <- conn:
+	default:
+		_ = conn.Close()
+	}
+}
+
+func (p *connPool) exchange(m *dns.Msg) (*dns.Msg, error) {
+	conn, reused, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	msg, _, err := p.client.ExchangeWithConn(m, conn)
+	if err != nil {
+		_ = conn.Close()
+		if !reused {
+			return nil, err
+		}
+		// idle connections may have been closed by the upstream
+		if conn, err = p.dial(); err != nil {
+			return nil, err
+		}
+		if msg, _, err = p.client.ExchangeWithConn(m, conn); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	p.put(conn)
+	return msg, nil
+}
+
+func (p *connPool) close() {
+	for {
+		select {
+		case conn := <-p.conns:
+			_ = conn.Close()
+		default:
+			return
+		}
+	}
+}
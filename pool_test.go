@@ -0,0 +1,106 @@
+package tinydns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stubStreamUpstream serves answers over tcp, or tls when a config is given, on a local port
+func stubStreamUpstream(b *testing.B, tlsConfig *tls.Config) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          listener,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			msg := &dns.Msg{}
+			msg.SetReply(r)
+			msg.Answer = append(msg.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(10, 0, 0, 1),
+			})
+			_ = w.WriteMsg(msg)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	b.Cleanup(func() { _ = server.Shutdown() })
+	return listener.Addr().String()
+}
+
+// selfSignedTLSConfig returns a server config with a throwaway certificate for 127.0.0.1
+func selfSignedTLSConfig(tb testing.TB) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}}}
+}
+
+func benchmarkExchange(b *testing.B, exchange func(*dns.Msg) (*dns.Msg, error)) {
+	r := &dns.Msg{}
+	r.SetQuestion("example.com.", dns.TypeA)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := exchange(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPoolTCP(b *testing.B) {
+	address := stubStreamUpstream(b, nil)
+	pool := newConnPool(&dns.Client{Net: "tcp"}, address)
+	defer pool.close()
+	benchmarkExchange(b, pool.exchange)
+}
+
+func BenchmarkNoPoolTCP(b *testing.B) {
+	address := stubStreamUpstream(b, nil)
+	client := &dns.Client{Net: "tcp"}
+	benchmarkExchange(b, func(r *dns.Msg) (*dns.Msg, error) {
+		msg, _, err := client.Exchange(r, address)
+		return msg, err
+	})
+}
+
+func BenchmarkPoolTLS(b *testing.B) {
+	address := stubStreamUpstream(b, selfSignedTLSConfig(b))
+	pool := newConnPool(&dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true}}, address)
+	defer pool.close()
+	benchmarkExchange(b, pool.exchange)
+}
+
+func BenchmarkNoPoolTLS(b *testing.B) {
+	address := stubStreamUpstream(b, selfSignedTLSConfig(b))
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	benchmarkExchange(b, func(r *dns.Msg) (*dns.Msg, error) {
+		msg, _, err := client.Exchange(r, address)
+		return msg, err
+	})
+}
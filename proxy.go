@@ -0,0 +1,44 @@
+package tinydns
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+// useProxy routes the upstreams through a SOCKS5 proxy, udp can't be proxied
+// so udp upstreams are forced to tcp
+func useProxy(proxyAddress string, source net.IP, upstreams []upstream) error {
+	// proxy.Direct has no timeout, so that an unreachable proxy would block forwarding
+	forward := &net.Dialer{Timeout: defaultDialTimeout}
+	if source != nil {
+		forward.LocalAddr = &net.TCPAddr{IP: source}
+	}
+	dialer, err := proxy.SOCKS5("tcp", proxyAddress, nil, forward)
+	if err != nil {
+		return err
+	}
+	for i := range upstreams {
+		if upstreams[i].net == "udp" {
+			upstreams[i].net = "tcp"
+		}
+		address := upstreams[i].address
+		client := &dns.Client{Net: upstreams[i].net, Timeout: upstreams[i].timeout}
+		pool := newConnPool(client, address)
+		pool.dial = func() (*dns.Conn, error) {
+			conn, err := dialer.Dial("tcp", address)
+			if err != nil {
+				return nil, err
+			}
+			if client.Net == "tcp-tls" {
+				host, _, _ := net.SplitHostPort(address)
+				conn = tls.Client(conn, &tls.Config{ServerName: host})
+			}
+			return &dns.Conn{Conn: conn}, nil
+		}
+		upstreams[i].pool = pool
+	}
+	return nil
+}
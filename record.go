@@ -0,0 +1,145 @@
+package tinydns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	sliceutil "github.com/projectdiscovery/utils/slice"
+)
+
+// recorder accumulates the upstream answers forwarded in record mode, both as records and
+// as the responses themselves for replay
+type recorder struct {
+	mu        sync.Mutex
+	records   map[string]*DnsRecord
+	responses map[replayKey]*dns.Msg
+}
+
+func newRecorder() *recorder {
+	return &recorder{records: make(map[string]*DnsRecord), responses: make(map[replayKey]*dns.Msg)}
+}
+
+// record adds the address, cname, txt, mx, ns and srv records of an upstream response, keeping
+// the first ttl seen per name, other types are only kept in the recorded responses
+func (rec *recorder) record(msg *dns.Msg) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(msg.Question) == 1 {
+		rec.responses[newReplayKey(msg.Question[0])] = msg.Copy()
+	}
+	for _, rr := range msg.Answer {
+		name := strings.ToLower(strings.TrimSuffix(rr.Header().Name, "."))
+		dnsRecord, ok := rec.records[name]
+		if !ok {
+			ttl := rr.Header().Ttl
+			dnsRecord = &DnsRecord{TTL: &ttl}
+		}
+		switch record := rr.(type) {
+		case *dns.A:
+			if value := record.A.String(); !sliceutil.Contains(dnsRecord.A, value) {
+				dnsRecord.A = append(dnsRecord.A, value)
+			}
+		case *dns.AAAA:
+			if value := record.AAAA.String(); !sliceutil.Contains(dnsRecord.AAAA, value) {
+				dnsRecord.AAAA = append(dnsRecord.AAAA, value)
+			}
+		case *dns.CNAME:
+			dnsRecord.CNAME = strings.TrimSuffix(record.Target, ".")
+		case *dns.TXT:
+			if value := strings.Join(record.Txt, ""); !sliceutil.Contains(dnsRecord.TXT, value) {
+				dnsRecord.TXT = append(dnsRecord.TXT, value)
+			}
+		case *dns.MX:
+			value := MXRecord{Preference: record.Preference, Host: strings.TrimSuffix(record.Mx, ".")}
+			if !sliceutil.Contains(dnsRecord.MX, value) {
+				dnsRecord.MX = append(dnsRecord.MX, value)
+			}
+		case *dns.NS:
+			if value := strings.TrimSuffix(record.Ns, "."); !sliceutil.Contains(dnsRecord.NS, value) {
+				dnsRecord.NS = append(dnsRecord.NS, value)
+			}
+		case *dns.SRV:
+			value := SRVRecord{Priority: record.Priority, Weight: record.Weight, Port: record.Port, Target: strings.TrimSuffix(record.Target, ".")}
+			if !sliceutil.Contains(dnsRecord.SRV, value) {
+				dnsRecord.SRV = append(dnsRecord.SRV, value)
+			}
+		default:
+			continue
+		}
+		rec.records[name] = dnsRecord
+	}
+}
+
+func (t *TinyDNS) recordAnswers(msg *dns.Msg) {
+	if t.recorder != nil {
+		t.recorder.record(msg)
+	}
+}
+
+// DumpConfig writes the options as DumpOptions does to path, with the upstream answers recorded
+// in record mode added to the records, so that the session can be replayed offline
+func (t *TinyDNS) DumpConfig(path string) error {
+	options := *t.options
+	options.DnsRecords = make(map[string]*DnsRecord, len(t.options.DnsRecords))
+	if t.recorder != nil {
+		t.recorder.mu.Lock()
+		for name, dnsRecord := range t.recorder.records {
+			options.DnsRecords[name] = dnsRecord
+		}
+		t.recorder.mu.Unlock()
+	}
+	// configured records take precedence over recorded ones
+	for name, dnsRecord := range t.options.DnsRecords {
+		options.DnsRecords[name] = dnsRecord
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := dumpOptions(file, options); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// DumpReplay writes the upstream responses forwarded in record mode to path in the format read
+// by ReplayFile, each wire format message prefixed with its two bytes length
+func (t *TinyDNS) DumpReplay(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := t.writeReplay(file); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (t *TinyDNS) writeReplay(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	if t.recorder != nil {
+		t.recorder.mu.Lock()
+		defer t.recorder.mu.Unlock()
+		for _, msg := range t.recorder.responses {
+			buf, err := msg.Pack()
+			if err != nil {
+				return err
+			}
+			if err := binary.Write(writer, binary.BigEndian, uint16(len(buf))); err != nil {
+				return err
+			}
+			if _, err := writer.Write(buf); err != nil {
+				return err
+			}
+		}
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,70 @@
+package tinydns
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecordedResponsesReplay(t *testing.T) {
+	tdns := &TinyDNS{recorder: newRecorder()}
+	r := &dns.Msg{}
+	r.SetQuestion("Example.com.", dns.TypeA)
+	msg := &dns.Msg{}
+	msg.SetReply(r)
+	msg.Answer = append(msg.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "Example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(10, 0, 0, 1),
+	})
+	tdns.recordAnswers(msg)
+
+	path := filepath.Join(t.TempDir(), "replay")
+	if err := tdns.DumpReplay(path); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := loadReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tdns.replay = replay
+
+	query := &dns.Msg{}
+	query.SetQuestion("example.com.", dns.TypeA)
+	reply := tdns.replayReply(query)
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Fatalf("unexpected replayed response: %v", reply)
+	}
+}
+
+func TestRecorderKeepsMailAndServiceRecords(t *testing.T) {
+	rec := newRecorder()
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeANY)
+	header := dns.RR_Header{Name: "example.com.", Class: dns.ClassINET, Ttl: 60}
+	msg.Answer = append(msg.Answer,
+		&dns.TXT{Hdr: header, Txt: []string{"v=spf1 ", "-all"}},
+		&dns.MX{Hdr: header, Preference: 10, Mx: "mail.example.com."},
+		&dns.NS{Hdr: header, Ns: "ns1.example.com."},
+		&dns.SRV{Hdr: header, Priority: 1, Weight: 2, Port: 443, Target: "svc.example.com."},
+	)
+	rec.record(msg)
+
+	dnsRecord := rec.records["example.com"]
+	if dnsRecord == nil {
+		t.Fatal("expected example.com to be recorded")
+	}
+	if len(dnsRecord.TXT) != 1 || dnsRecord.TXT[0] != "v=spf1 -all" {
+		t.Fatalf("unexpected txt records: %v", dnsRecord.TXT)
+	}
+	if len(dnsRecord.MX) != 1 || dnsRecord.MX[0] != (MXRecord{Preference: 10, Host: "mail.example.com"}) {
+		t.Fatalf("unexpected mx records: %v", dnsRecord.MX)
+	}
+	if len(dnsRecord.NS) != 1 || dnsRecord.NS[0] != "ns1.example.com" {
+		t.Fatalf("unexpected ns records: %v", dnsRecord.NS)
+	}
+	if len(dnsRecord.SRV) != 1 || dnsRecord.SRV[0] != (SRVRecord{Priority: 1, Weight: 2, Port: 443, Target: "svc.example.com"}) {
+		t.Fatalf("unexpected srv records: %v", dnsRecord.SRV)
+	}
+}
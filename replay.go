@@ -0,0 +1,70 @@
+package tinydns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type replayKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+func newReplayKey(question dns.Question) replayKey {
+	return replayKey{name: strings.ToLower(question.Name), qtype: question.Qtype, qclass: question.Qclass}
+}
+
+// loadReplay indexes the recorded responses of a replay file by their question, the file holding
+// wire format messages each prefixed with its two bytes length as over tcp
+func loadReplay(path string) (map[replayKey]*dns.Msg, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	responses := make(map[replayKey]*dns.Msg)
+	reader := bufio.NewReader(file)
+	for {
+		var length uint16
+		if err := binary.Read(reader, binary.BigEndian, &length); errors.Is(err, io.EOF) {
+			return responses, nil
+		} else if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		msg := &dns.Msg{}
+		if err := msg.Unpack(buf); err != nil {
+			return nil, fmt.Errorf("invalid recorded message %d: %w", len(responses)+1, err)
+		}
+		if len(msg.Question) != 1 {
+			return nil, fmt.Errorf("recorded message %d must have a single question", len(responses)+1)
+		}
+		responses[newReplayKey(msg.Question[0])] = msg
+	}
+}
+
+// replayReply answers with the recorded response to the question, SERVFAIL when none was recorded
+func (t *TinyDNS) replayReply(r *dns.Msg) *dns.Msg {
+	recorded, ok := t.replay[newReplayKey(r.Question[0])]
+	if !ok {
+		msg := &dns.Msg{}
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		return msg
+	}
+	msg := recorded.Copy()
+	msg.Id = r.Id
+	msg.Question = r.Question
+	return msg
+}
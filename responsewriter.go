@@ -0,0 +1,73 @@
+package tinydns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// memoryResponseWriter is a dns.ResponseWriter keeping the written message in memory
+type memoryResponseWriter struct {
+	msg        *dns.Msg
+	remoteAddr net.Addr
+}
+
+func (w *memoryResponseWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (w *memoryResponseWriter) RemoteAddr() net.Addr {
+	if w.remoteAddr != nil {
+		return w.remoteAddr
+	}
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (w *memoryResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func (w *memoryResponseWriter) Write(data []byte) (int, error) {
+	msg := &dns.Msg{}
+	if err := msg.Unpack(data); err != nil {
+		return 0, err
+	}
+	w.msg = msg
+	return len(data), nil
+}
+
+func (w *memoryResponseWriter) Close() error        { return nil }
+func (w *memoryResponseWriter) TsigStatus() error   { return nil }
+func (w *memoryResponseWriter) TsigTimersOnly(bool) {}
+func (w *memoryResponseWriter) Hijack()             {}
+
+// TestResponseWriter is an in-memory dns.ResponseWriter recording every written
+// message, so that tests can call ServeDNS directly and inspect the responses
+type TestResponseWriter struct {
+	memoryResponseWriter
+	Msgs []*dns.Msg
+}
+
+func NewTestResponseWriter() *TestResponseWriter {
+	return &TestResponseWriter{}
+}
+
+// SetRemoteAddr sets the client address, tcp loopback by default
+func (w *TestResponseWriter) SetRemoteAddr(addr net.Addr) {
+	w.remoteAddr = addr
+}
+
+func (w *TestResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.Msgs = append(w.Msgs, msg)
+	return nil
+}
+
+func (w *TestResponseWriter) Write(data []byte) (int, error) {
+	msg := &dns.Msg{}
+	if err := msg.Unpack(data); err != nil {
+		return 0, err
+	}
+	w.Msgs = append(w.Msgs, msg)
+	return len(data), nil
+}
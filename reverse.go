@@ -0,0 +1,153 @@
+package tinydns
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type reverseZone struct {
+	apex     string
+	network  *net.IPNet
+	template string
+	soa      *SOARecord
+	ns       []string
+}
+
+func newReverseZones(zones []ReverseZone) ([]reverseZone, error) {
+	var reverseZones []reverseZone
+	for _, zone := range zones {
+		_, network, err := net.ParseCIDR(zone.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reverse zone cidr: %w", err)
+		}
+		if _, ok := dns.IsDomainName(renderPTR(zone.Template, network.IP)); !ok || zone.Template == "" {
+			return nil, fmt.Errorf("invalid template for reverse zone %s: %q", zone.CIDR, zone.Template)
+		}
+		reverseZones = append(reverseZones, reverseZone{
+			apex:     reverseApex(network),
+			network:  network,
+			template: zone.Template,
+			soa:      zone.SOA,
+			ns:       zone.NS,
+		})
+	}
+	return reverseZones, nil
+}
+
+// reverseApex returns the in-addr.arpa or ip6.arpa name of the network, rounded
+// down to the enclosing octet or nibble boundary
+func reverseApex(network *net.IPNet) string {
+	ones, bits := network.Mask.Size()
+	if bits == 8*net.IPv4len {
+		apex := "in-addr.arpa."
+		for _, octet := range network.IP.To4()[:ones/8] {
+			apex = strconv.Itoa(int(octet)) + "." + apex
+		}
+		return apex
+	}
+	apex := "ip6.arpa."
+	for _, nibble := range hex.EncodeToString(network.IP.To16())[:ones/4] {
+		apex = string(nibble) + "." + apex
+	}
+	return apex
+}
+
+// renderPTR substitutes {ip} in the template with the dashed address (eg. ip-{ip}.internal gives ip-10-0-0-5.internal)
+func renderPTR(template string, ip net.IP) string {
+	dashed := strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+	return dns.Fqdn(strings.ReplaceAll(template, "{ip}", dashed))
+}
+
+// reverseIP returns the address of a full in-addr.arpa or ip6.arpa name
+func reverseIP(domain string) net.IP {
+	name := strings.ToLower(dns.Fqdn(domain))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		slices.Reverse(labels)
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+		var address strings.Builder
+		for i := len(labels) - 1; i >= 0; i-- {
+			if len(labels[i]) != 1 {
+				return nil
+			}
+			address.WriteString(labels[i])
+			if i%4 == 0 && i > 0 {
+				address.WriteByte(':')
+			}
+		}
+		return net.ParseIP(address.String())
+	}
+	return nil
+}
+
+// reverseZoneReply answers PTR queries for addresses within a reverse zone by rendering its template,
+// zones with a SOA are authoritative and also answer SOA and NS at their apex and negatively otherwise
+func (t *TinyDNS) reverseZoneReply(r *dns.Msg, domain string) (*dns.Msg, bool) {
+	name := strings.ToLower(domain)
+	for _, zone := range t.reverseZones {
+		if !dns.IsSubDomain(zone.apex, name) {
+			continue
+		}
+		msg := dns.Msg{}
+		msg.SetReply(r)
+		msg.Authoritative = true
+		ttl := t.ttl(&DnsRecord{})
+		qtype := r.Question[0].Qtype
+		ip := reverseIP(name)
+		switch {
+		case ip != nil && zone.network.Contains(ip):
+			if qtype == dns.TypePTR {
+				msg.Answer = append(msg.Answer, &dns.PTR{
+					Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+					Ptr: renderPTR(zone.template, ip),
+				})
+			}
+		case name == zone.apex:
+			if qtype == dns.TypeSOA && zone.soa != nil {
+				msg.Answer = append(msg.Answer, soaRecord(domain, ttl, zone.soa))
+			}
+			if qtype == dns.TypeNS {
+				for _, ns := range zone.ns {
+					msg.Answer = append(msg.Answer, &dns.NS{
+						Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+						Ns:  dns.Fqdn(ns),
+					})
+				}
+			}
+		case ip != nil || dns.CountLabel(name) >= fullReverseLabels(zone.apex):
+			msg.Rcode = dns.RcodeNameError
+		}
+		if len(msg.Answer) == 0 {
+			if zone.soa == nil {
+				return nil, false
+			}
+			msg.Ns = append(msg.Ns, negativeSOA(soaRecord(zone.apex, ttl, zone.soa)))
+		}
+		return &msg, true
+	}
+	return nil, false
+}
+
+// fullReverseLabels returns the label count of the reverse name of a single address,
+// shorter names within a zone are empty non-terminals
+func fullReverseLabels(apex string) int {
+	if strings.HasSuffix(apex, "ip6.arpa.") {
+		return 2*net.IPv6len + 2
+	}
+	return net.IPv4len + 2
+}
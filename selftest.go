@@ -0,0 +1,58 @@
+package tinydns
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+var selfTestTypes = []uint16{
+	dns.TypeA,
+	dns.TypeAAAA,
+	dns.TypeCNAME,
+	dns.TypeTXT,
+	dns.TypeMX,
+	dns.TypeNS,
+	dns.TypeSRV,
+	dns.TypeNAPTR,
+	dns.TypeURI,
+	dns.TypeSOA,
+}
+
+// SelfTest verifies that every in-memory record without command produces a valid wire message
+// and that at least one upstream is reachable
+func (t *TinyDNS) SelfTest() error {
+	for domain, dnsRecord := range t.options.DnsRecords {
+		// commands are not run for the check
+		if dnsRecord.Exec != "" {
+			continue
+		}
+		for _, qtype := range selfTestTypes {
+			r := &dns.Msg{}
+			r.SetQuestion(dns.Fqdn(domain), qtype)
+			if _, err := t.reply(r, r.Question[0].Name, dnsRecord).Pack(); err != nil {
+				return fmt.Errorf("could not pack %s response for %s: %w", dns.TypeToString[qtype], domain, err)
+			}
+		}
+	}
+
+	if len(t.upstreams) == 0 {
+		return nil
+	}
+	var reachable int
+	for _, upstream := range t.upstreams {
+		r := &dns.Msg{}
+		r.SetQuestion(".", dns.TypeNS)
+		if _, err := t.exchange(r, upstream); err != nil {
+			t.logger.Errorf("Upstream %s is not reachable: %s\n", upstream.address, err)
+			continue
+		}
+		t.logger.Infof("Upstream %s is reachable\n", upstream.address)
+		reachable++
+	}
+	if reachable == 0 {
+		return errors.New("no upstream is reachable")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package tinydns
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxShadowRunning bounds the shadow queries in flight, comparisons are dropped beyond it
+const maxShadowRunning = 64
+
+// shadow mirrors the forwarded query to the shadow upstream in the background,
+// logging the differences with the primary response without affecting it
+func (t *TinyDNS) shadow(r *dns.Msg, primary *dns.Msg, primaryAddress string) {
+	if t.shadowUpstream == nil {
+		return
+	}
+	select {
+	case t.shadowSlots <- struct{}{}:
+	default:
+		return
+	}
+	r = r.Copy()
+	rcode, answers := dns.RcodeToString[primary.Rcode], answerSet(primary)
+	go func() {
+		defer func() { <-t.shadowSlots }()
+		domain := strings.TrimSuffix(r.Question[0].Name, ".")
+		msg, err := t.exchange(r, *t.shadowUpstream)
+		if err != nil {
+			t.logger.Errorf("Could not retrieve records for %s with shadow upstream %s: %s\n", domain, t.shadowUpstream.address, err)
+			return
+		}
+		shadowRcode, shadowAnswers := dns.RcodeToString[msg.Rcode], answerSet(msg)
+		if rcode != shadowRcode || !slices.Equal(answers, shadowAnswers) {
+			t.logger.Errorf("Shadow upstream %s differs from %s for %s: %s %v, expected %s %v\n",
+				t.shadowUpstream.address, primaryAddress, domain, shadowRcode, shadowAnswers, rcode, answers)
+		}
+	}()
+}
+
+// answerSet returns the sorted answers without their ttl, for comparison
+func answerSet(msg *dns.Msg) []string {
+	var answers []string
+	for _, rr := range msg.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		answers = append(answers, strings.ToLower(rr.String()))
+	}
+	slices.Sort(answers)
+	return answers
+}
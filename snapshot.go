@@ -0,0 +1,92 @@
+package tinydns
+
+import (
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheSnapshot holds the cache entries with the expiry of those tracked for stale answers
+type cacheSnapshot struct {
+	Entries map[string][]byte
+	Expires map[string]time.Time
+}
+
+// loadSnapshot warms the cache with the entries of a previous snapshot, a missing file is not an error,
+// entries of unknown expiry are loaded as stale so that they are refreshed on their first hit
+func (t *TinyDNS) loadSnapshot(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var snapshot cacheSnapshot
+	if err := gob.NewDecoder(file).Decode(&snapshot); err != nil {
+		return err
+	}
+	now := time.Now()
+	for key, value := range snapshot.Entries {
+		if err := t.hm.Set(key, value); err != nil {
+			return err
+		}
+		expires, ok := snapshot.Expires[key]
+		if !ok {
+			expires = now
+		}
+		t.expiries.mu.Lock()
+		t.expiries.expires[key] = expires
+		t.expiries.mu.Unlock()
+	}
+	return nil
+}
+
+// saveSnapshot writes all the cache entries to path, replacing the previous snapshot at once
+func (t *TinyDNS) saveSnapshot(path string) error {
+	snapshot := cacheSnapshot{Entries: make(map[string][]byte), Expires: make(map[string]time.Time)}
+	t.hm.Scan(func(key, value []byte) error {
+		// scanned buffers may be reused by the store
+		snapshot.Entries[string(key)] = append([]byte(nil), value...)
+		return nil
+	})
+	t.expiries.mu.Lock()
+	for key, expires := range t.expiries.expires {
+		snapshot.Expires[key] = expires
+	}
+	t.expiries.mu.Unlock()
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if err := gob.NewEncoder(file).Encode(snapshot); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// snapshot saves the cache every interval until done is closed
+func (t *TinyDNS) snapshot(path string, interval time.Duration, done <-chan struct{}) {
+	defer t.snapshotWG.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.saveSnapshot(path); err != nil {
+				t.logger.Errorf("Could not save cache snapshot: %s\n", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
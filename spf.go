@@ -0,0 +1,61 @@
+package tinydns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxSPFLookups bounds the names followed from an SPF record, as SPF evaluation does (RFC 7208)
+const maxSPFLookups = 10
+
+// spfAdditional returns the TXT records of the configured names the SPF record of domain includes
+// or redirects to, following their own references
+func (t *TinyDNS) spfAdditional(domain, txt string) []dns.RR {
+	var rrs []dns.RR
+	// the answered domain is not repeated
+	visited := map[string]struct{}{strings.ToLower(strings.TrimSuffix(domain, ".")): {}}
+	targets := spfTargets(txt)
+	for len(targets) > 0 && len(visited) <= maxSPFLookups {
+		target := targets[0]
+		targets = targets[1:]
+		if _, ok := visited[target]; ok {
+			continue
+		}
+		visited[target] = struct{}{}
+		dnsRecord, ok := t.lookupRecord(target)
+		if !ok {
+			continue
+		}
+		for _, value := range dnsRecord.TXT {
+			rrs = append(rrs, &dns.TXT{
+				Hdr: dns.RR_Header{Name: dns.Fqdn(target), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: t.ttl(dnsRecord)},
+				Txt: splitTXT(value),
+			})
+			targets = append(targets, spfTargets(value)...)
+		}
+	}
+	return rrs
+}
+
+// spfTargets returns the include and redirect domains of an SPF record, skipping macros
+func spfTargets(txt string) []string {
+	fields := strings.Fields(txt)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "v=spf1") {
+		return nil
+	}
+	var targets []string
+	for _, field := range fields[1:] {
+		field = strings.ToLower(strings.TrimLeft(field, "+-~?"))
+		var target string
+		if strings.HasPrefix(field, "include:") {
+			target = strings.TrimPrefix(field, "include:")
+		} else if strings.HasPrefix(field, "redirect=") {
+			target = strings.TrimPrefix(field, "redirect=")
+		}
+		if target != "" && !strings.Contains(target, "%") {
+			targets = append(targets, strings.TrimSuffix(target, "."))
+		}
+	}
+	return targets
+}
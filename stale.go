@@ -0,0 +1,119 @@
+package tinydns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	sliceutil "github.com/projectdiscovery/utils/slice"
+)
+
+// staleTTL caps the ttl of stale answers, which clients only keep briefly (RFC 8767)
+const staleTTL = 30
+
+// servedTTL returns the ttl a cached answer is served with, stale ones being capped to staleTTL
+func servedTTL(ttl uint32, stale bool) uint32 {
+	if stale {
+		return min(ttl, staleTTL)
+	}
+	return ttl
+}
+
+// cacheExpiries tracks when cached upstream records and messages expire, entries past their ttl
+// are served stale within the revalidate window, if any, while being refreshed in background
+type cacheExpiries struct {
+	mu         sync.Mutex
+	window     time.Duration
+	expires    map[string]time.Time
+	refreshing map[string]struct{}
+}
+
+func newCacheExpiries(window time.Duration) *cacheExpiries {
+	return &cacheExpiries{
+		window:     window,
+		expires:    make(map[string]time.Time),
+		refreshing: make(map[string]struct{}),
+	}
+}
+
+func (t *TinyDNS) setCacheExpiry(key string, ttl uint32) {
+	t.expiries.mu.Lock()
+	defer t.expiries.mu.Unlock()
+	t.expiries.expires[key] = time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+// cacheExpired reports whether the cache entry is past the revalidate window
+func (t *TinyDNS) cacheExpired(key string) bool {
+	t.expiries.mu.Lock()
+	defer t.expiries.mu.Unlock()
+	expires, ok := t.expiries.expires[key]
+	return ok && time.Now().After(expires.Add(t.expiries.window))
+}
+
+// cacheFresh reports whether the cache entry is known to be within its ttl
+func (t *TinyDNS) cacheFresh(key string) bool {
+	t.expiries.mu.Lock()
+	defer t.expiries.mu.Unlock()
+	expires, ok := t.expiries.expires[key]
+	return ok && time.Now().Before(expires)
+}
+
+// cacheStale reports whether the cache entry is past its ttl
+func (t *TinyDNS) cacheStale(key string) bool {
+	t.expiries.mu.Lock()
+	defer t.expiries.mu.Unlock()
+	expires, ok := t.expiries.expires[key]
+	return ok && time.Now().After(expires)
+}
+
+// revalidate refreshes the cached records of domain from upstream, at most once at a time, DNSSEC
+// aware queries also refresh the cached message
+func (t *TinyDNS) revalidate(r *dns.Msg, domain string) {
+	key := domain
+	if dnssecOK(r) {
+		key = signedCacheKey(domain)
+	}
+	t.expiries.mu.Lock()
+	if _, ok := t.expiries.refreshing[key]; ok {
+		t.expiries.mu.Unlock()
+		return
+	}
+	t.expiries.refreshing[key] = struct{}{}
+	t.expiries.mu.Unlock()
+
+	go func() {
+		defer func() {
+			t.expiries.mu.Lock()
+			delete(t.expiries.refreshing, key)
+			t.expiries.mu.Unlock()
+		}()
+		upstreamServer := sliceutil.PickRandom(t.upstreams)
+		msg, err := t.exchange(r, upstreamServer)
+		if err != nil {
+			t.logger.Errorf("Could not revalidate records for %s with upstream %s: %s\n", domain, upstreamServer.address, err)
+			return
+		}
+		t.recordAnswers(msg)
+		dnsRecord, ok := cacheableRecord(msg)
+		if !ok {
+			return
+		}
+		msgBytes, err := msg.Pack()
+		if err != nil {
+			t.logger.Errorf("Could not pack message for %s: %s\n", domain, err)
+			return
+		}
+		if dnssecOK(r) {
+			if err := t.storeMessage(domain, msgBytes, *dnsRecord.TTL); err != nil {
+				t.logger.Errorf("Could not save message for %s in cache: %s\n", domain, err)
+			}
+		}
+		if len(msg.Answer) == 0 {
+			if err := t.storeNegative(domain, msgBytes, *dnsRecord.TTL); err != nil {
+				t.logger.Errorf("Could not save negative answer for %s in cache: %s\n", domain, err)
+			}
+		} else if err := t.storeRecord(domain, dnsRecord); err != nil {
+			t.logger.Errorf("Could not save records for %s in cache: %s\n", domain, err)
+		}
+	}()
+}
@@ -0,0 +1,124 @@
+package tinydns
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// UpstreamStat holds the forwarding counters of an upstream
+type UpstreamStat struct {
+	Success uint64
+	Failure uint64
+	// Latency is the average duration of the successful exchanges
+	Latency time.Duration
+}
+
+type upstreamStats struct {
+	mu      sync.Mutex
+	stats   map[string]*UpstreamStat
+	latency map[string]time.Duration
+}
+
+func newUpstreamStats() *upstreamStats {
+	return &upstreamStats{
+		stats:   make(map[string]*UpstreamStat),
+		latency: make(map[string]time.Duration),
+	}
+}
+
+func (s *upstreamStats) record(address string, err error, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stat, ok := s.stats[address]
+	if !ok {
+		stat = &UpstreamStat{}
+		s.stats[address] = stat
+	}
+	if err != nil {
+		stat.Failure++
+		return
+	}
+	stat.Success++
+	s.latency[address] += latency
+	stat.Latency = s.latency[address] / time.Duration(stat.Success)
+}
+
+// UpstreamStats returns the forwarding counters keyed by upstream address
+func (t *TinyDNS) UpstreamStats() map[string]UpstreamStat {
+	t.upstreamStats.mu.Lock()
+	defer t.upstreamStats.mu.Unlock()
+	stats := make(map[string]UpstreamStat, len(t.upstreamStats.stats))
+	for address, stat := range t.upstreamStats.stats {
+		stats[address] = *stat
+	}
+	return stats
+}
+
+// latencySamples bounds the recent response times kept per source for the percentiles
+const latencySamples = 1024
+
+// LatencyStat summarizes the response times of a source over its recent queries
+type LatencyStat struct {
+	Count uint64
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+}
+
+type latencyStats struct {
+	mu      sync.Mutex
+	counts  map[string]uint64
+	samples map[string][]time.Duration
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{
+		counts:  make(map[string]uint64),
+		samples: make(map[string][]time.Duration),
+	}
+}
+
+// record keeps the response time in the ring of recent samples of the source
+func (s *latencyStats) record(source string, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := s.counts[source]
+	if samples := s.samples[source]; len(samples) < latencySamples {
+		s.samples[source] = append(samples, latency)
+	} else {
+		samples[count%latencySamples] = latency
+	}
+	s.counts[source] = count + 1
+}
+
+// latencySource returns the source a response is accounted to, its operation except for
+// forwarded queries, which are reported as cached operations with their upstream
+func latencySource(info Info) string {
+	if info.Operation == "cached" && info.Upstream != "" {
+		return "upstream"
+	}
+	return info.Operation
+}
+
+// LatencyStats returns the response time percentiles keyed by source (eg. in-memory, cached or
+// upstream), computed over the last queries of each source
+func (t *TinyDNS) LatencyStats() map[string]LatencyStat {
+	t.latencyStats.mu.Lock()
+	defer t.latencyStats.mu.Unlock()
+	stats := make(map[string]LatencyStat, len(t.latencyStats.samples))
+	for source, samples := range t.latencyStats.samples {
+		sorted := slices.Clone(samples)
+		slices.Sort(sorted)
+		percentile := func(p int) time.Duration {
+			return sorted[(len(sorted)-1)*p/100]
+		}
+		stats[source] = LatencyStat{
+			Count: t.latencyStats.counts[source],
+			P50:   percentile(50),
+			P90:   percentile(90),
+			P99:   percentile(99),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,43 @@
+package tinydns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLatencyStats(t *testing.T) {
+	tdns, err := New(&Options{DnsRecords: map[string]*DnsRecord{"example.com": {A: []string{"10.0.0.1"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+
+	for i := 0; i < 2; i++ {
+		r := &dns.Msg{}
+		r.SetQuestion("example.com.", dns.TypeA)
+		tdns.ServeDNS(NewTestResponseWriter(), r)
+	}
+	if stat := tdns.LatencyStats()["in-memory"]; stat.Count != 2 {
+		t.Fatalf("expected 2 in-memory responses, got %+v", stat)
+	}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	stats := newLatencyStats()
+	// the oldest samples are replaced once the ring is full
+	for i := 0; i < latencySamples; i++ {
+		stats.record("upstream", time.Hour)
+	}
+	for i := 1; i <= latencySamples; i++ {
+		stats.record("upstream", time.Duration(i)*time.Millisecond)
+	}
+	stat := (&TinyDNS{latencyStats: stats}).LatencyStats()["upstream"]
+	if stat.Count != 2*latencySamples {
+		t.Fatalf("expected %d responses, got %d", 2*latencySamples, stat.Count)
+	}
+	if stat.P50 != 512*time.Millisecond || stat.P90 != 921*time.Millisecond || stat.P99 != 1013*time.Millisecond {
+		t.Fatalf("unexpected percentiles: %+v", stat)
+	}
+}
@@ -0,0 +1,64 @@
+package tinydns
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const syntheticIndex = "{n}"
+
+func validateSyntheticZone(zone *SyntheticZone) error {
+	if strings.Count(zone.Pattern, syntheticIndex) != 1 {
+		return fmt.Errorf("synthetic zone pattern must contain %s once: %q", syntheticIndex, zone.Pattern)
+	}
+	if zone.Count == 0 {
+		return fmt.Errorf("synthetic zone count must be positive")
+	}
+	base := net.ParseIP(zone.BaseIP)
+	if base == nil {
+		return fmt.Errorf("invalid synthetic zone base ip: %q", zone.BaseIP)
+	}
+	if syntheticAddress(base, zone.Count-1) == nil {
+		return fmt.Errorf("synthetic zone of %d addresses overflows from %s", zone.Count, zone.BaseIP)
+	}
+	return nil
+}
+
+// syntheticRecord computes the address record of a name generated from the synthetic zone pattern
+func (t *TinyDNS) syntheticRecord(domain string) (*DnsRecord, bool) {
+	zone := t.options.SyntheticZone
+	if zone == nil {
+		return nil, false
+	}
+	name := strings.ToLower(strings.TrimSuffix(domain, "."))
+	prefix, suffix, _ := strings.Cut(strings.ToLower(strings.TrimSuffix(zone.Pattern, ".")), syntheticIndex)
+	if len(name) <= len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return nil, false
+	}
+	index := name[len(prefix) : len(name)-len(suffix)]
+	n, err := strconv.ParseUint(index, 10, 64)
+	// each index has a single name, without sign or leading zeros
+	if err != nil || n >= zone.Count || strconv.FormatUint(n, 10) != index {
+		return nil, false
+	}
+	ip := syntheticAddress(net.ParseIP(zone.BaseIP), n)
+	if ip.To4() != nil {
+		return &DnsRecord{A: []string{ip.String()}}, true
+	}
+	return &DnsRecord{AAAA: []string{ip.String()}}, true
+}
+
+// syntheticAddress returns the address n after base, or nil when it overflows the family
+func syntheticAddress(base net.IP, n uint64) net.IP {
+	if ip4 := base.To4(); ip4 != nil {
+		base = ip4
+	}
+	sum := new(big.Int).Add(new(big.Int).SetBytes(base), new(big.Int).SetUint64(n))
+	if sum.BitLen() > len(base)*8 {
+		return nil
+	}
+	return net.IP(sum.FillBytes(make([]byte, len(base))))
+}
@@ -0,0 +1,32 @@
+package tinydns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const templateIP = "{ip}"
+
+// templateRecord computes the address record from the first label of the domain according to the
+// template, eg. ip-{ip} answers ip-10-0-0-1.example.com with 10.0.0.1 and ip-2001-db8--1.example.com with 2001:db8::1
+func templateRecord(template, domain string) (*DnsRecord, bool) {
+	labels := dns.SplitDomainName(domain)
+	if len(labels) == 0 {
+		return nil, false
+	}
+	label := strings.ToLower(labels[0])
+	prefix, suffix, _ := strings.Cut(strings.ToLower(template), templateIP)
+	if len(label) < len(prefix)+len(suffix) || !strings.HasPrefix(label, prefix) || !strings.HasSuffix(label, suffix) {
+		return nil, false
+	}
+	dashed := label[len(prefix) : len(label)-len(suffix)]
+	if ip := net.ParseIP(strings.ReplaceAll(dashed, "-", ".")); ip != nil && ip.To4() != nil {
+		return &DnsRecord{A: []string{ip.String()}}, true
+	}
+	if ip := net.ParseIP(strings.ReplaceAll(dashed, "-", ":")); ip != nil {
+		return &DnsRecord{AAAA: []string{ip.String()}}, true
+	}
+	return nil, false
+}
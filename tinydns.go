@@ -2,21 +2,68 @@ package tinydns
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/tls"
 	"encoding/gob"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/http"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/projectdiscovery/hmap/store/hybrid"
 	sliceutil "github.com/projectdiscovery/utils/slice"
+	"github.com/quic-go/quic-go"
 )
 
+const (
+	defaultTTL    = 60
+	maxCNAMEDepth = 8
+)
+
+var combinedTypes = []uint16{
+	dns.TypeA,
+	dns.TypeAAAA,
+	dns.TypeTXT,
+	dns.TypeMX,
+	dns.TypeNS,
+	dns.TypeSRV,
+	dns.TypeNAPTR,
+	dns.TypeURI,
+}
+
 type TinyDNS struct {
-	options    *Options
-	server     *dns.Server
-	hm         *hybrid.HybridMap
-	OnServeDns func(data Info)
+	options          *Options
+	server           *dns.Server
+	dohServer        *http.Server
+	doqTLS           *tls.Config
+	doqListener      *quic.Listener
+	backendClient    *http.Client
+	hm               *hybrid.HybridMap
+	upstreams        []upstream
+	reverseUpstreams []upstream
+	shadowUpstream   *upstream
+	shadowSlots      chan struct{}
+	upstreamStats    *upstreamStats
+	latencyStats     *latencyStats
+	logger           Logger
+	cookieSecret     []byte
+	zones            *zoneStore
+	reverseZones     []reverseZone
+	denyAnswerNets   []*net.IPNet
+	rates            *rateCounter
+	expiries         *cacheExpiries
+	snapshotDone     chan struct{}
+	snapshotWG       sync.WaitGroup
+	recorder         *recorder
+	exec             *execRunner
+	replay           map[replayKey]*dns.Msg
+	OnServeDns       func(data Info)
 }
 
 type Info struct {
@@ -25,17 +72,198 @@ type Info struct {
 	Wildcard  bool
 	Msg       string
 	Upstream  string
+	// EDNS reports whether the query carried an OPT record
+	EDNS bool
+	// ID correlates the callbacks of a single query
+	ID string
+	// start is when the query was received, for the latency stats
+	start time.Time
 }
 
+// New creates a server from the options, the names of DnsRecords are lowercased in place and the
+// map is looked up on every query, so records added afterwards must be keyed by their lowercase name
 func New(options *Options) (*TinyDNS, error) {
-	hm, err := hybrid.New(hybrid.DefaultDiskOptions)
+	if err := validateRecords(options.DnsRecords); err != nil {
+		return nil, err
+	}
+	if err := normalizeRecords(options.DnsRecords); err != nil {
+		return nil, err
+	}
+	if options.UseSystemResolvers {
+		systemResolvers, err := systemResolvers()
+		if err != nil {
+			return nil, err
+		}
+		options.UpstreamServers = append(options.UpstreamServers, systemResolvers...)
+	}
+	if err := validateAnswerOrder(options.AnswerOrder); err != nil {
+		return nil, err
+	}
+	if err := validateMultiQuestion(options.MultiQuestion); err != nil {
+		return nil, err
+	}
+	if err := validateMalformedQuestion(options.MalformedQuestion); err != nil {
+		return nil, err
+	}
+	if options.SyntheticZone != nil {
+		if err := validateSyntheticZone(options.SyntheticZone); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateDDR(options); err != nil {
+		return nil, err
+	}
+	if options.CatchAllCNAME != "" {
+		if _, ok := dns.IsDomainName(options.CatchAllCNAME); !ok {
+			return nil, fmt.Errorf("invalid catch-all cname: %s", options.CatchAllCNAME)
+		}
+	}
+	if options.TTLJitter < 0 || options.TTLJitter > 100 {
+		return nil, fmt.Errorf("invalid ttl jitter: %d, expected a percentage between 0 and 100", options.TTLJitter)
+	}
+	for qtype := range options.ResponseDelays {
+		if _, ok := dns.StringToType[qtype]; !ok {
+			return nil, fmt.Errorf("invalid response delay type: %s", qtype)
+		}
+	}
+	upstreams, err := parseUpstreams(options.UpstreamServers, options.UpstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	reverseUpstreams, err := parseUpstreams(options.ReverseUpstreamServers, options.UpstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var shadowUpstreams []upstream
+	if options.ShadowUpstream != "" {
+		if shadowUpstreams, err = parseUpstreams([]string{options.ShadowUpstream}, options.UpstreamTimeout); err != nil {
+			return nil, err
+		}
+	}
+	var source net.IP
+	if options.UpstreamSourceIP != "" {
+		if source, err = sourceIP(options.UpstreamSourceIP); err != nil {
+			return nil, err
+		}
+	}
+	if options.ProxyAddress != "" {
+		if err := useProxy(options.ProxyAddress, source, upstreams); err != nil {
+			return nil, err
+		}
+		if err := useProxy(options.ProxyAddress, source, reverseUpstreams); err != nil {
+			return nil, err
+		}
+		if err := useProxy(options.ProxyAddress, source, shadowUpstreams); err != nil {
+			return nil, err
+		}
+	} else if source != nil {
+		useSourceIP(source, upstreams)
+		useSourceIP(source, reverseUpstreams)
+		useSourceIP(source, shadowUpstreams)
+	}
+	reverseZones, err := newReverseZones(options.ReverseZones)
+	if err != nil {
+		return nil, err
+	}
+	denyAnswerNets, err := parseDenyAnswerCIDRs(options.DenyAnswerCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	var doqTLS *tls.Config
+	if options.Net == "doq" {
+		if doqTLS, err = doqTLSConfig(options); err != nil {
+			return nil, err
+		}
+	}
+
+	hmOptions := hybrid.DefaultDiskOptions
+	// a configured cache dir belongs to this instance and is kept on close
+	if options.CacheDir != "" {
+		hmOptions.Path = options.CacheDir
+		hmOptions.Cleanup = false
+	}
+	hm, err := hybrid.New(hmOptions)
 	if err != nil {
 		return nil, err
 	}
 
 	tinydns := &TinyDNS{
-		options: options,
-		hm:      hm,
+		options:          options,
+		hm:               hm,
+		upstreams:        upstreams,
+		reverseUpstreams: reverseUpstreams,
+		reverseZones:     reverseZones,
+		denyAnswerNets:   denyAnswerNets,
+		doqTLS:           doqTLS,
+		upstreamStats:    newUpstreamStats(),
+		latencyStats:     newLatencyStats(),
+		exec:             newExecRunner(),
+		logger:           options.Logger,
+	}
+	// initialization failures release the cache directory and zone watcher
+	fail := func(err error) (*TinyDNS, error) {
+		if tinydns.zones != nil {
+			tinydns.zones.close()
+		}
+		hm.Close()
+		return nil, err
+	}
+	if len(shadowUpstreams) > 0 {
+		tinydns.shadowUpstream = &shadowUpstreams[0]
+		tinydns.shadowSlots = make(chan struct{}, maxShadowRunning)
+	}
+	if tinydns.logger == nil {
+		tinydns.logger = DefaultLogger
+	}
+	if options.HTTPBackend != "" {
+		timeout := options.UpstreamTimeout
+		if timeout == 0 {
+			timeout = defaultBackendTimeout
+		}
+		tinydns.backendClient = &http.Client{Timeout: timeout}
+	}
+	if options.ZoneDir != "" {
+		zones, err := newZoneStore(options.ZoneDir)
+		if err != nil {
+			return fail(err)
+		}
+		if err := zones.watch(tinydns.logger); err != nil {
+			return fail(err)
+		}
+		tinydns.zones = zones
+	}
+	if options.AmplificationProtection {
+		tinydns.rates = newRateCounter()
+	}
+	if options.ReplayFile != "" {
+		replay, err := loadReplay(options.ReplayFile)
+		if err != nil {
+			return fail(err)
+		}
+		tinydns.replay = replay
+	}
+	if options.RecordMode {
+		tinydns.recorder = newRecorder()
+	}
+	tinydns.expiries = newCacheExpiries(options.StaleRevalidateWindow)
+	if options.CacheSnapshotFile != "" {
+		if err := tinydns.loadSnapshot(options.CacheSnapshotFile); err != nil {
+			return fail(err)
+		}
+		if options.CacheSnapshotInterval > 0 {
+			tinydns.snapshotDone = make(chan struct{})
+			tinydns.snapshotWG.Add(1)
+			go tinydns.snapshot(options.CacheSnapshotFile, options.CacheSnapshotInterval, tinydns.snapshotDone)
+		}
+	}
+	if options.DNSCookies {
+		tinydns.cookieSecret = options.CookieSecret
+		if len(tinydns.cookieSecret) == 0 {
+			tinydns.cookieSecret = make([]byte, 32)
+			if _, err := crand.Read(tinydns.cookieSecret); err != nil {
+				return fail(err)
+			}
+		}
 	}
 
 	srv := &dns.Server{
@@ -43,13 +271,49 @@ func New(options *Options) (*TinyDNS, error) {
 		Net:     options.Net,
 		Handler: tinydns,
 	}
+	if options.MultiQuestion == MultiQuestionAnswer {
+		srv.MsgAcceptFunc = acceptMultiQuestion
+	}
+	if options.TCPKeepalive > 0 {
+		srv.IdleTimeout = func() time.Duration { return options.TCPKeepalive }
+	}
 	tinydns.server = srv
 
 	return tinydns, nil
 }
 
 func (t *TinyDNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	t.serveDNS(w, r, fmt.Sprintf("%08x", rand.Uint32()))
+}
+
+// serveDNS answers the query with the callbacks correlated by id
+func (t *TinyDNS) serveDNS(w dns.ResponseWriter, r *dns.Msg, id string) {
 	var info Info
+	info.ID = id
+	info.start = time.Now()
+	info.EDNS = r.IsEdns0() != nil
+	if msg := t.checkQuery(r); msg != nil {
+		info.Operation = "rejected"
+		info.Msg = "Rejected malformed request.\n"
+		if t.OnServeDns != nil {
+			t.OnServeDns(info)
+		}
+		t.writeMsg(w, r, msg, info)
+		return
+	}
+	if len(r.Question) > 1 {
+		info.Operation = "multi-question"
+		info.Msg = fmt.Sprintf("Answering %d questions separately.\n", len(r.Question))
+		if t.OnServeDns != nil {
+			t.OnServeDns(info)
+		}
+		t.writeMsg(w, r, t.answerQuestions(w, r, info.ID), info)
+		return
+	}
+	// latency injection per query type
+	if delay, ok := t.options.ResponseDelays[dns.TypeToString[r.Question[0].Qtype]]; ok {
+		time.Sleep(delay)
+	}
 	domain := r.Question[0].Name
 	domainlookup := strings.TrimSuffix(domain, ".")
 	info.Domain = domainlookup
@@ -58,32 +322,216 @@ func (t *TinyDNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	if t.OnServeDns != nil {
 		t.OnServeDns(info)
 	}
-	switch r.Question[0].Qtype {
-	case dns.TypeA:
-		// attempts in order to retrieve the record in the following fallback-chain
-		if dnsRecord, ok := t.options.DnsRecords[domainlookup]; ok { // - hardcoded records
-			info.Domain = domainlookup
-			info.Operation = "in-memory"
-			info.Wildcard = false
-			info.Msg = fmt.Sprintf("Using in-memory record for %s.\n", domainlookup)
+	// replayed sessions answer only with recorded responses
+	if t.replay != nil {
+		info.Operation = "replay"
+		info.Msg = fmt.Sprintf("Replaying recorded response for %s.\n", domainlookup)
+		if t.OnServeDns != nil {
+			t.OnServeDns(info)
+		}
+		t.writeMsg(w, r, t.replayReply(r), info)
+		return
+	}
+	if t.options.AmplificationProtection {
+		if msg := t.amplificationReply(w, r); msg != nil {
+			info.Operation = "truncated"
+			info.Msg = fmt.Sprintf("Truncating response for %s to %s over rate threshold.\n", domainlookup, clientIP(w))
 			if t.OnServeDns != nil {
 				t.OnServeDns(info)
 			}
-			_ = w.WriteMsg(reply(r, domain, dnsRecord))
-
-		} else if dnsRecord, ok = t.options.DnsRecords["*"]; ok { // - wildcard
+			t.writeMsg(w, r, msg, info)
+			return
+		}
+	}
+	if t.options.DNSCookies {
+		if msg := t.checkCookie(w, r); msg != nil {
+			t.writeMsg(w, r, msg, info)
+			return
+		}
+	}
+	if t.options.ServerID != "" && isServerIDQuery(r.Question[0]) {
+		t.writeMsg(w, r, t.serverIDReply(r), info)
+		return
+	}
+	if t.options.DDR != "" && isDDRQuery(r.Question[0]) {
+		t.writeMsg(w, r, t.ddrReply(r), info)
+		return
+	}
+	// attempts in order to retrieve the record in the following fallback-chain
+	qclass := r.Question[0].Qclass
+	if dnsRecord, ok := t.lookupRecord(domainlookup); ok && matchesClass(dnsRecord, qclass) { // - hardcoded records
+		info.Domain = domainlookup
+		info.Operation = "in-memory"
+		info.Wildcard = false
+		info.Msg = fmt.Sprintf("Using in-memory record for %s.\n", domainlookup)
+		if t.OnServeDns != nil {
+			t.OnServeDns(info)
+		}
+		t.writeRecord(w, r, domain, dnsRecord, info)
+		return
+	} else if msg, ok := t.zoneReply(r, domain); ok { // - zone files
+		info.Domain = domainlookup
+		info.Operation = "zone"
+		info.Wildcard = false
+		info.Msg = fmt.Sprintf("Using zone record for %s.\n", domainlookup)
+		if t.OnServeDns != nil {
+			t.OnServeDns(info)
+		}
+		t.writeMsg(w, r, msg, info)
+		return
+	} else if msg, ok := t.reverseZoneReply(r, domain); ok { // - reverse zones
+		info.Domain = domainlookup
+		info.Operation = "reverse-zone"
+		info.Wildcard = false
+		info.Msg = fmt.Sprintf("Using reverse zone template for %s.\n", domainlookup)
+		if t.OnServeDns != nil {
+			t.OnServeDns(info)
+		}
+		t.writeMsg(w, r, msg, info)
+		return
+	} else if dnsRecord, ok = t.syntheticRecord(domain); ok && matchesClass(dnsRecord, qclass) { // - synthetic zone
+		info.Domain = domainlookup
+		info.Operation = "synthetic"
+		info.Wildcard = false
+		info.Msg = fmt.Sprintf("Using synthetic record for %s.\n", domainlookup)
+		if t.OnServeDns != nil {
+			t.OnServeDns(info)
+		}
+		t.writeMsg(w, r, t.reply(r, domain, dnsRecord), info)
+		return
+	} else if dnsRecord, ok = t.lookupWildcard(domainlookup); ok && matchesClass(dnsRecord, qclass) { // - wildcard
+		// templated wildcards compute the address from the queried label
+		if dnsRecord.Template != "" {
+			if templated, ok := templateRecord(dnsRecord.Template, domain); ok {
+				templated.TTL = dnsRecord.TTL
+				dnsRecord = templated
+			}
+		}
+		info.Domain = domainlookup
+		info.Operation = "in-memory"
+		info.Wildcard = true
+		info.Msg = fmt.Sprintf("Using in-memory wildcard record for %s.\n", domainlookup)
+		if t.OnServeDns != nil {
+			t.OnServeDns(info)
+		}
+		t.writeRecord(w, r, domain, dnsRecord, info)
+		return
+	}
+	// names of authoritative zones are never forwarded
+	if t.isAuthoritative(domain) {
+		info.Domain = domainlookup
+		info.Operation = "authoritative"
+		info.Wildcard = false
+		info.Msg = fmt.Sprintf("Using authoritative zone for %s.\n", domainlookup)
+		if t.OnServeDns != nil {
+			t.OnServeDns(info)
+		}
+		dnsRecord := &DnsRecord{Rcode: "NXDOMAIN"}
+		if t.hasSubdomains(domain) {
+			// empty non-terminal
+			dnsRecord = &DnsRecord{}
+		}
+		t.writeMsg(w, r, t.reply(r, domain, dnsRecord), info)
+		return
+	}
+	// unmatched names are redirected to the sink instead of being forwarded, except the sink itself,
+	// the redirect being an IN record only queries in that class are answered with it
+	if sink := t.options.CatchAllCNAME; sink != "" && matchesClass(&DnsRecord{}, r.Question[0].Qclass) &&
+		!strings.EqualFold(domainlookup, strings.TrimSuffix(sink, ".")) {
+		info.Domain = domainlookup
+		info.Operation = "catch-all"
+		info.Wildcard = false
+		info.Msg = fmt.Sprintf("Redirecting %s to %s.\n", domainlookup, sink)
+		if t.OnServeDns != nil {
+			t.OnServeDns(info)
+		}
+		t.writeMsg(w, r, t.reply(r, domain, &DnsRecord{CNAME: sink}), info)
+		return
+	}
+	// reverse lookups are forwarded as is, preferring the dedicated upstreams
+	if isReverse(domain) && !t.options.OfflineMode {
+		upstreams := t.reverseUpstreams
+		if len(upstreams) == 0 {
+			upstreams = t.upstreams
+		}
+		if len(upstreams) > 0 {
+			upstreamServer := sliceutil.PickRandom(upstreams)
 			info.Domain = domainlookup
-			info.Operation = "in-memory"
-			info.Wildcard = true
-			info.Msg = fmt.Sprintf("Using in-memory wildcard record for %s.\n", domainlookup)
+			info.Operation = "forward"
+			info.Wildcard = false
+			info.Upstream = upstreamServer.address
+			info.Msg = fmt.Sprintf("Retrieving records for %s with upstream %s.\n", domainlookup, upstreamServer.address)
 			if t.OnServeDns != nil {
 				t.OnServeDns(info)
 			}
-			_ = w.WriteMsg(reply(r, domain, dnsRecord))
-		} else if dnsRecordBytes, ok := t.hm.Get(domain); ok { // - cache
+			msg, err := t.exchange(r, upstreamServer)
+			if err != nil {
+				t.logger.Errorf("[%s] Could not retrieve records for %s with upstream %s: %s\n", info.ID, domainlookup, upstreamServer.address, err)
+			} else {
+				t.shadow(r, msg, upstreamServer.address)
+				t.writeMsg(w, r, msg, info)
+				return
+			}
+		}
+	}
+	// cache and upstream only hold address records
+	isA := r.Question[0].Qtype == dns.TypeA
+	// names are cached case insensitively, responses keep the query case
+	cacheKey := strings.ToLower(domain)
+	if isA {
+		if dnssecOK(r) {
+			// DNSSEC aware clients are served the full upstream message so that signatures survive caching
+			if msgBytes, ok := t.hm.Get(signedCacheKey(cacheKey)); ok && !t.cacheExpired(signedCacheKey(cacheKey)) { // - cache
+				msg := &dns.Msg{}
+				if err := msg.Unpack(msgBytes); err != nil {
+					t.logger.Errorf("[%s] Could not decode cached message for %s: %s\n", info.ID, domainlookup, err)
+				} else {
+					info.Domain = domainlookup
+					info.Operation = "cached"
+					info.Wildcard = false
+					info.Msg = fmt.Sprintf("Using cached message for %s.\n", domainlookup)
+					if t.OnServeDns != nil {
+						t.OnServeDns(info)
+					}
+					msg.Id = r.Id
+					msg.Question = r.Question
+					stale := t.cacheStale(signedCacheKey(cacheKey))
+					for _, rr := range msg.Answer {
+						if strings.EqualFold(rr.Header().Name, domain) {
+							rr.Header().Name = domain
+						}
+						rr.Header().Ttl = servedTTL(rr.Header().Ttl, stale)
+					}
+					t.writeMsg(w, r, msg, info)
+					if stale && len(t.upstreams) > 0 && !t.options.OfflineMode {
+						t.revalidate(r.Copy(), cacheKey)
+					}
+					return
+				}
+			}
+		} else if msgBytes, ok := t.hm.Get(negativeCacheKey(cacheKey)); ok && t.cacheFresh(negativeCacheKey(cacheKey)) { // - cache
+			msg := &dns.Msg{}
+			if err := msg.Unpack(msgBytes); err != nil {
+				t.logger.Errorf("[%s] Could not decode cached message for %s: %s\n", info.ID, domainlookup, err)
+			} else {
+				info.Domain = domainlookup
+				info.Operation = "cached"
+				info.Wildcard = false
+				info.Msg = fmt.Sprintf("Using cached negative answer for %s.\n", domainlookup)
+				if t.OnServeDns != nil {
+					t.OnServeDns(info)
+				}
+				msg.Id = r.Id
+				msg.Question = r.Question
+				t.writeMsg(w, r, msg, info)
+				return
+			}
+		} else if dnsRecordBytes, ok := t.hm.Get(cacheKey); ok && !t.cacheExpired(cacheKey) { // - cache
 			dnsRecord := &DnsRecord{}
 			err := gob.NewDecoder(bytes.NewReader(dnsRecordBytes)).Decode(dnsRecord)
-			if err == nil {
+			if err != nil {
+				t.logger.Errorf("[%s] Could not decode cached record for %s: %s\n", info.ID, domainlookup, err)
+			} else {
 				info.Domain = domainlookup
 				info.Operation = "cached"
 				info.Wildcard = false
@@ -91,72 +539,852 @@ func (t *TinyDNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 				if t.OnServeDns != nil {
 					t.OnServeDns(info)
 				}
-				_ = w.WriteMsg(reply(r, domain, dnsRecord))
+				if t.options.TTLJitter > 0 {
+					ttl := jitterTTL(t.ttl(dnsRecord), t.options.TTLJitter)
+					dnsRecord.TTL = &ttl
+				}
+				stale := t.cacheStale(cacheKey)
+				ttl := servedTTL(t.ttl(dnsRecord), stale)
+				dnsRecord.TTL = &ttl
+				t.writeMsg(w, r, t.reply(r, domain, dnsRecord), info)
+				// stale answers are refreshed in the background
+				if stale && len(t.upstreams) > 0 && !t.options.OfflineMode {
+					t.revalidate(r.Copy(), cacheKey)
+				}
+				return
 			}
-		} else if len(t.options.UpstreamServers) > 0 {
+		}
+	}
+	if t.options.HTTPBackend != "" && !t.options.OfflineMode {
+		msg, err := t.backendReply(r, domain)
+		if err != nil {
+			t.logger.Errorf("[%s] Could not retrieve records for %s with http backend: %s\n", info.ID, domainlookup, err)
+		} else if msg != nil {
+			info.Domain = domainlookup
+			info.Operation = "backend"
+			info.Wildcard = false
+			info.Upstream = t.options.HTTPBackend
+			info.Msg = fmt.Sprintf("Retrieving records for %s with http backend.\n", domainlookup)
+			if t.OnServeDns != nil {
+				t.OnServeDns(info)
+			}
+			t.writeMsg(w, r, msg, info)
+			return
+		}
+	}
+	if isA {
+		if len(t.upstreams) > 0 && !t.options.OfflineMode {
 			// upstream and store in cache
-			upstreamServer := sliceutil.PickRandom(t.options.UpstreamServers)
+			upstreamServer := sliceutil.PickRandom(t.upstreams)
 			info.Domain = domainlookup
 			info.Operation = "cached"
 			info.Wildcard = false
-			info.Upstream = upstreamServer
-			info.Msg = fmt.Sprintf("Retrieving records for %s with upstream %s.\n", domainlookup, upstreamServer)
+			info.Upstream = upstreamServer.address
+			info.Msg = fmt.Sprintf("Retrieving records for %s with upstream %s.\n", domainlookup, upstreamServer.address)
 			if t.OnServeDns != nil {
 				t.OnServeDns(info)
 			}
-			msg, err := dns.Exchange(r, upstreamServer)
-			if err == nil {
-				_ = w.WriteMsg(msg)
-				dnsRecord := &DnsRecord{}
-				for _, record := range msg.Answer {
-					switch recordType := record.(type) {
-					case *dns.A:
-						dnsRecord.A = append(dnsRecord.A, recordType.A.String())
-					case *dns.AAAA:
-						dnsRecord.AAAA = append(dnsRecord.AAAA, recordType.AAAA.String())
+			msg, err := t.exchange(r, upstreamServer)
+			if err != nil {
+				t.logger.Errorf("[%s] Could not retrieve records for %s with upstream %s: %s\n", info.ID, domainlookup, upstreamServer.address, err)
+			} else {
+				dnsRecord, cacheable := cacheableRecord(msg)
+				negative := cacheable && len(msg.Answer) == 0
+				// packed before writing as the response may still be modified
+				var msgBytes []byte
+				if dnssecOK(r) || negative {
+					msgBytes, _ = msg.Pack()
+				}
+				t.shadow(r, msg, upstreamServer.address)
+				t.recordAnswers(msg)
+				t.writeMsg(w, r, msg, info)
+				if !cacheable {
+					return
+				}
+				info.Domain = domainlookup
+				info.Operation = "saving"
+				info.Wildcard = false
+				info.Upstream = upstreamServer.address
+				info.Msg = fmt.Sprintf("Saving records for %s in cache.\n", domainlookup)
+				if t.OnServeDns != nil {
+					t.OnServeDns(info)
+				}
+				if negative {
+					if err := t.storeNegative(cacheKey, msgBytes, *dnsRecord.TTL); err != nil {
+						t.logger.Errorf("[%s] Could not save negative answer for %s in cache: %s\n", info.ID, domainlookup, err)
 					}
+				} else if err := t.storeRecord(cacheKey, dnsRecord); err != nil {
+					t.logger.Errorf("[%s] Could not save records for %s in cache: %s\n", info.ID, domainlookup, err)
 				}
-				var dnsRecordBytes bytes.Buffer
-				if err := gob.NewEncoder(&dnsRecordBytes).Encode(dnsRecord); err == nil {
-					info.Domain = domainlookup
-					info.Operation = "saving"
-					info.Wildcard = false
-					info.Upstream = upstreamServer
-					info.Msg = fmt.Sprintf("Saving records for %s in cache.\n", domainlookup)
-					if t.OnServeDns != nil {
-						t.OnServeDns(info)
+				if dnssecOK(r) && len(msgBytes) > 0 {
+					if err := t.storeMessage(cacheKey, msgBytes, *dnsRecord.TTL); err != nil {
+						t.logger.Errorf("[%s] Could not save message for %s in cache: %s\n", info.ID, domainlookup, err)
 					}
-					_ = t.hm.Set(domain, dnsRecordBytes.Bytes())
 				}
+				return
 			}
 		}
 	}
-	_ = w.WriteMsg(reply(r, domain, &DnsRecord{}))
+	if t.options.OfflineMode {
+		// nothing known locally and upstreams are never queried
+		t.writeMsg(w, r, t.reply(r, domain, &DnsRecord{Rcode: "SERVFAIL"}), info)
+		return
+	}
+	t.writeMsg(w, r, t.reply(r, domain, &DnsRecord{}), info)
+}
+
+// cacheableRecord extracts the address records to cache from an upstream response,
+// errors, NODATA without SOA and zero ttls are not cacheable
+func cacheableRecord(msg *dns.Msg) (*DnsRecord, bool) {
+	if msg.Rcode != dns.RcodeSuccess {
+		return nil, false
+	}
+	dnsRecord := &DnsRecord{}
+	for _, record := range msg.Answer {
+		// a zero ttl asks not to be cached
+		if ttl := record.Header().Ttl; ttl == 0 {
+			return nil, false
+		} else if dnsRecord.TTL == nil || ttl < *dnsRecord.TTL {
+			dnsRecord.TTL = &ttl
+		}
+		switch recordType := record.(type) {
+		case *dns.A:
+			dnsRecord.A = append(dnsRecord.A, recordType.A.String())
+		case *dns.AAAA:
+			dnsRecord.AAAA = append(dnsRecord.AAAA, recordType.AAAA.String())
+		}
+	}
+	// NODATA is cached with the negative ttl from the SOA (RFC 2308)
+	if len(msg.Answer) == 0 {
+		ttl, ok := negativeTTL(msg)
+		if !ok || ttl == 0 {
+			return nil, false
+		}
+		dnsRecord.TTL = &ttl
+	}
+	return dnsRecord, true
+}
+
+func (t *TinyDNS) storeRecord(domain string, dnsRecord *DnsRecord) error {
+	var dnsRecordBytes bytes.Buffer
+	if err := gob.NewEncoder(&dnsRecordBytes).Encode(dnsRecord); err != nil {
+		return err
+	}
+	if err := t.hm.Set(domain, dnsRecordBytes.Bytes()); err != nil {
+		return err
+	}
+	t.setCacheExpiry(domain, *dnsRecord.TTL)
+	// the name has records again
+	_ = t.hm.Del(negativeCacheKey(domain))
+	return nil
+}
+
+// storeNegative caches a NODATA upstream message as received, so that it is served with its SOA
+// in the authority section, expiring with the negative ttl (RFC 2308)
+func (t *TinyDNS) storeNegative(domain string, msgBytes []byte, ttl uint32) error {
+	if err := t.hm.Set(negativeCacheKey(domain), msgBytes); err != nil {
+		return err
+	}
+	t.setCacheExpiry(negativeCacheKey(domain), ttl)
+	_ = t.hm.Del(domain)
+	return nil
+}
+
+// storeMessage caches the full upstream message served to DNSSEC aware clients, expiring on its own
+func (t *TinyDNS) storeMessage(domain string, msgBytes []byte, ttl uint32) error {
+	if err := t.hm.Set(signedCacheKey(domain), msgBytes); err != nil {
+		return err
+	}
+	t.setCacheExpiry(signedCacheKey(domain), ttl)
+	return nil
+}
+
+// negativeCacheKey returns the cache key of the NODATA upstream messages
+func negativeCacheKey(domain string) string {
+	return "nodata:" + domain
+}
+
+// signedCacheKey returns the cache key of the full upstream message served to DNSSEC aware clients
+func signedCacheKey(domain string) string {
+	return "dnssec:" + domain
+}
+
+const resolvConfPath = "/etc/resolv.conf"
+
+func systemResolvers() ([]string, error) {
+	config, err := dns.ClientConfigFromFile(resolvConfPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read system resolvers: %w", err)
+	}
+	var servers []string
+	for _, server := range config.Servers {
+		servers = append(servers, net.JoinHostPort(server, config.Port))
+	}
+	return servers, nil
 }
 
-func reply(r *dns.Msg, domain string, dnsRecord *DnsRecord) *dns.Msg {
+// Query resolves the request through the ServeDNS logic without going over the network
+func (t *TinyDNS) Query(r *dns.Msg) *dns.Msg {
+	w := &memoryResponseWriter{}
+	t.ServeDNS(w, r)
+	return w.msg
+}
+
+func (t *TinyDNS) writeMsg(w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg, info Info) {
+	t.writeMsgCompressed(w, r, msg, info, t.options.Compress)
+}
+
+// writeRecord answers with the in-memory record as seen from the client
+func (t *TinyDNS) writeRecord(w dns.ResponseWriter, r *dns.Msg, domain string, dnsRecord *DnsRecord, info Info) {
+	dnsRecord = selectView(dnsRecord, clientIP(w))
+	// records forcing tcp are only answered over tcp, for testing client retries
+	if dnsRecord.ForceTCP && isUDP(w) {
+		t.writeMsg(w, r, truncatedReply(r), info)
+		return
+	}
+	t.writeMsgCompressed(w, r, t.reply(r, domain, dnsRecord), info, t.compress(dnsRecord))
+}
+
+// truncatedReply asks the client to retry over tcp
+func truncatedReply(r *dns.Msg) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetReply(r)
+	msg.Truncated = true
+	return msg
+}
+
+// compress returns whether answers of the record are compressed, the server default unless overridden
+func (t *TinyDNS) compress(dnsRecord *DnsRecord) bool {
+	if dnsRecord.Compress != nil {
+		return *dnsRecord.Compress
+	}
+	return t.options.Compress
+}
+
+func (t *TinyDNS) writeMsgCompressed(w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg, info Info, compress bool) {
+	orderAnswers(msg.Answer, t.options.AnswerOrder, clientIP(w))
+	if t.options.NSID != "" {
+		setNSID(r, msg, t.options.NSID)
+	}
+	if t.options.TCPKeepalive > 0 {
+		setKeepalive(w, r, msg, t.options.TCPKeepalive)
+	}
+	if t.options.DNSCookies {
+		t.setCookie(w, r, msg)
+	}
+	if t.options.AfterResolve != nil {
+		if resp := t.options.AfterResolve(r, msg, info); resp != nil {
+			msg = resp
+		}
+	}
+	if t.options.MalformedQuestion != "" {
+		malformQuestion(msg, t.options.MalformedQuestion)
+	}
+	msg.Compress = compress
+	if t.options.MaxUDPSize > 0 && isUDP(w) {
+		truncate(msg, t.options.MaxUDPSize, compress)
+	}
+	err := w.WriteMsg(msg)
+	if size := maxResponseSize(w, r); err != nil && msg.Len() > size {
+		// too large to be packed or sent, retried truncated
+		truncate(msg, size, compress)
+		err = w.WriteMsg(msg)
+	}
+	if err != nil {
+		t.logger.Errorf("[%s] Could not write response for %s: %s\n", info.ID, info.Domain, err)
+	}
+	if !info.start.IsZero() {
+		t.latencyStats.record(latencySource(info), time.Since(info.start))
+	}
+}
+
+// truncate fits the message in size with the configured compression, Truncate counting on
+// compression the records are dropped further until the uncompressed message fits
+func truncate(msg *dns.Msg, size int, compress bool) {
+	msg.Truncate(size)
+	msg.Compress = compress
+	if compress || msg.IsTsig() != nil {
+		return
+	}
+	size = max(size, dns.MinMsgSize)
+	for msg.Len() > size {
+		switch {
+		case dropExtra(msg):
+		case len(msg.Ns) > 0:
+			msg.Ns = msg.Ns[:len(msg.Ns)-1]
+		case len(msg.Answer) > 0:
+			msg.Answer = msg.Answer[:len(msg.Answer)-1]
+		default:
+			return
+		}
+		msg.Truncated = true
+	}
+}
+
+// dropExtra removes the last additional record other than the OPT one
+func dropExtra(msg *dns.Msg) bool {
+	for i := len(msg.Extra) - 1; i >= 0; i-- {
+		if msg.Extra[i].Header().Rrtype != dns.TypeOPT {
+			msg.Extra = append(msg.Extra[:i], msg.Extra[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// maxResponseSize returns the largest response the client accepts over the transport
+func maxResponseSize(w dns.ResponseWriter, r *dns.Msg) int {
+	if !isUDP(w) {
+		return dns.MaxMsgSize
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+func isUDP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.UDPAddr)
+	return ok
+}
+
+func isReverse(domain string) bool {
+	return dns.IsSubDomain("in-addr.arpa.", domain) || dns.IsSubDomain("ip6.arpa.", domain)
+}
+
+func clientIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// selectView returns the first view matching the client address, or the record itself
+func selectView(dnsRecord *DnsRecord, ip net.IP) *DnsRecord {
+	if ip == nil {
+		return dnsRecord
+	}
+	for _, view := range dnsRecord.Views {
+		if _, ipnet, err := net.ParseCIDR(view.CIDR); err == nil && ipnet.Contains(ip) && !view.Record.Disabled {
+			return view.Record
+		}
+	}
+	return dnsRecord
+}
+
+func (t *TinyDNS) reply(r *dns.Msg, domain string, dnsRecord *DnsRecord) *dns.Msg {
 	msg := dns.Msg{}
 	msg.SetReply(r)
 	msg.Authoritative = true
+	if dnsRecord.RequireEDNS && r.IsEdns0() == nil {
+		msg.Rcode = dns.RcodeFormatError
+		return &msg
+	} else if dnsRecord.Rcode != "" {
+		msg.Rcode = dns.StringToRcode[dnsRecord.Rcode]
+	} else if dnsRecord.Exec != "" {
+		rrs, err := t.exec.records(dnsRecord.Exec, domain, r.Question[0].Qtype, t.ttl(dnsRecord))
+		if err != nil {
+			t.logger.Errorf("Could not run command for %s: %s\n", domain, err)
+			msg.Rcode = dns.RcodeServerFailure
+		}
+		msg.Answer = append(msg.Answer, rrs...)
+	} else {
+		qtype := r.Question[0].Qtype
+		t.answer(&msg, qtype, domain, dnsRecord)
+		// combined records answer with all their types once the queried one matches
+		if dnsRecord.Combine && dnsRecord.CNAME == "" && len(msg.Answer) > 0 {
+			for _, combinedType := range combinedTypes {
+				if combinedType != qtype {
+					t.answer(&msg, combinedType, domain, dnsRecord)
+				}
+			}
+		}
+	}
+	// flag overrides, for crafting unusual responses
+	if dnsRecord.AA != nil {
+		msg.Authoritative = *dnsRecord.AA
+	}
+	if dnsRecord.RA != nil {
+		msg.RecursionAvailable = *dnsRecord.RA
+	}
+	if dnsRecord.AD != nil {
+		msg.AuthenticatedData = *dnsRecord.AD
+	}
+	if dnsRecord.TC != nil {
+		msg.Truncated = *dnsRecord.TC
+	}
+	// answers are built in the IN class
+	if class := recordClass(dnsRecord); class != dns.ClassINET {
+		for _, rr := range msg.Answer {
+			rr.Header().Class = class
+		}
+	}
+	// negative answers carry the zone SOA so that resolvers can cache them
+	if len(msg.Answer) == 0 {
+		if soa := t.zoneSOA(domain); soa != nil {
+			msg.Ns = append(msg.Ns, negativeSOA(soa))
+		}
+	}
+	return &msg
+}
+
+// recordClass returns the class of the record, IN by default
+func recordClass(dnsRecord *DnsRecord) uint16 {
+	if dnsRecord.Class == "" {
+		return dns.ClassINET
+	}
+	return dns.StringToClass[strings.ToUpper(dnsRecord.Class)]
+}
+
+func matchesClass(dnsRecord *DnsRecord, qclass uint16) bool {
+	return qclass == dns.ClassANY || qclass == recordClass(dnsRecord)
+}
+
+func (t *TinyDNS) answer(msg *dns.Msg, qtype uint16, domain string, dnsRecord *DnsRecord) {
+	ttl := t.ttl(dnsRecord)
+	if dnsRecord.CNAME != "" {
+		msg.Answer = append(msg.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: domain, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+			Target: dns.Fqdn(dnsRecord.CNAME),
+		})
+		if qtype != dns.TypeCNAME {
+			t.chaseCNAME(msg, qtype, dns.Fqdn(dnsRecord.CNAME))
+		}
+		return
+	}
+	switch qtype {
+	case dns.TypeA:
+		if address := pickWeighted(dnsRecord.Weighted, false); address != "" {
+			msg.Answer = append(msg.Answer, t.capAddresses(addressRecords(domain, ttl, &DnsRecord{A: []string{address}}))...)
+		} else {
+			msg.Answer = append(msg.Answer, t.capAddresses(addressRecords(domain, ttl, &DnsRecord{A: dnsRecord.A}))...)
+		}
+	case dns.TypeAAAA:
+		if address := pickWeighted(dnsRecord.Weighted, true); address != "" {
+			msg.Answer = append(msg.Answer, t.capAddresses(addressRecords(domain, ttl, &DnsRecord{AAAA: []string{address}}))...)
+		} else {
+			msg.Answer = append(msg.Answer, t.capAddresses(addressRecords(domain, ttl, &DnsRecord{AAAA: dnsRecord.AAAA}))...)
+		}
+	case dns.TypeTXT:
+		for _, txt := range dnsRecord.TXT {
+			msg.Answer = append(msg.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+				Txt: splitTXT(txt),
+			})
+			if t.options.SPFAdditional {
+				msg.Extra = append(msg.Extra, t.spfAdditional(domain, txt)...)
+			}
+		}
+	case dns.TypeMX:
+		for _, mx := range dnsRecord.MX {
+			msg.Answer = append(msg.Answer, &dns.MX{
+				Hdr:        dns.RR_Header{Name: domain, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: ttl},
+				Preference: mx.Preference,
+				Mx:         dns.Fqdn(mx.Host),
+			})
+			msg.Extra = append(msg.Extra, t.additional(mx.Host)...)
+		}
+	case dns.TypeNS:
+		for _, ns := range dnsRecord.NS {
+			msg.Answer = append(msg.Answer, &dns.NS{
+				Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+				Ns:  dns.Fqdn(ns),
+			})
+			// glue
+			msg.Extra = append(msg.Extra, t.additional(ns)...)
+		}
+	case dns.TypeSRV:
+		for _, srv := range dnsRecord.SRV {
+			msg.Answer = append(msg.Answer, &dns.SRV{
+				Hdr:      dns.RR_Header{Name: domain, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+				Priority: srv.Priority,
+				Weight:   srv.Weight,
+				Port:     srv.Port,
+				Target:   dns.Fqdn(srv.Target),
+			})
+			msg.Extra = append(msg.Extra, t.additional(srv.Target)...)
+		}
+	case dns.TypeNAPTR:
+		for _, naptr := range dnsRecord.NAPTR {
+			msg.Answer = append(msg.Answer, &dns.NAPTR{
+				Hdr:         dns.RR_Header{Name: domain, Rrtype: dns.TypeNAPTR, Class: dns.ClassINET, Ttl: ttl},
+				Order:       naptr.Order,
+				Preference:  naptr.Preference,
+				Flags:       naptr.Flags,
+				Service:     naptr.Service,
+				Regexp:      naptr.Regexp,
+				Replacement: dns.Fqdn(naptr.Replacement),
+			})
+		}
+	case dns.TypeURI:
+		for _, uri := range dnsRecord.URI {
+			msg.Answer = append(msg.Answer, &dns.URI{
+				Hdr:      dns.RR_Header{Name: domain, Rrtype: dns.TypeURI, Class: dns.ClassINET, Ttl: ttl},
+				Priority: uri.Priority,
+				Weight:   uri.Weight,
+				Target:   uri.Target,
+			})
+		}
+	case dns.TypeSOA:
+		if dnsRecord.SOA != nil {
+			msg.Answer = append(msg.Answer, soaRecord(domain, ttl, dnsRecord.SOA))
+		}
+	case dns.TypeHTTPS:
+		if t.options.ApexHTTPS && t.isApex(domain, dnsRecord) {
+			if https := apexHTTPS(domain, ttl, dnsRecord); https != nil {
+				msg.Answer = append(msg.Answer, https)
+			}
+		}
+	case dns.TypeANY:
+		for _, value := range dnsRecord.ANY {
+			// validated when the records are loaded
+			if rr, err := anyRecord(domain, ttl, value); err == nil {
+				msg.Answer = append(msg.Answer, rr)
+			}
+		}
+	}
+}
+
+// isApex reports whether the domain is the apex of a zone, holding its SOA or being authoritative
+func (t *TinyDNS) isApex(domain string, dnsRecord *DnsRecord) bool {
+	if dnsRecord.SOA != nil {
+		return true
+	}
+	for _, zone := range t.options.AuthoritativeZones {
+		if strings.EqualFold(dns.Fqdn(zone), dns.Fqdn(domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// apexHTTPS synthesizes the HTTPS record of the apex with address hints from its A and AAAA records
+func apexHTTPS(domain string, ttl uint32, dnsRecord *DnsRecord) dns.RR {
+	var ipv4, ipv6 []net.IP
 	for _, a := range dnsRecord.A {
-		msg.Answer = append(msg.Answer, &dns.A{
-			Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		ipv4 = append(ipv4, net.ParseIP(a))
+	}
+	for _, aaaa := range dnsRecord.AAAA {
+		ipv6 = append(ipv6, net.ParseIP(aaaa))
+	}
+	if len(ipv4) == 0 && len(ipv6) == 0 {
+		return nil
+	}
+	https := &dns.HTTPS{SVCB: dns.SVCB{
+		Hdr:      dns.RR_Header{Name: domain, Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: ttl},
+		Priority: 1,
+		Target:   ".",
+	}}
+	if len(ipv4) > 0 {
+		https.Value = append(https.Value, &dns.SVCBIPv4Hint{Hint: ipv4})
+	}
+	if len(ipv6) > 0 {
+		https.Value = append(https.Value, &dns.SVCBIPv6Hint{Hint: ipv6})
+	}
+	return https
+}
+
+// anyRecord builds a canned ANY answer from its type and value (eg. "TXT hello")
+func anyRecord(domain string, ttl uint32, value string) (dns.RR, error) {
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s", domain, ttl, value))
+	if err == nil && rr == nil {
+		err = fmt.Errorf("empty record")
+	}
+	return rr, err
+}
+
+// splitTXT splits a txt value in character strings of at most 255 bytes
+func splitTXT(txt string) []string {
+	var chunks []string
+	for len(txt) > 255 {
+		chunks = append(chunks, txt[:255])
+		txt = txt[255:]
+	}
+	return append(chunks, txt)
+}
+
+// chaseCNAME appends the records of the cname target, either from the in-memory
+// records or, when FlattenCNAME is enabled, resolved through an upstream
+func (t *TinyDNS) chaseCNAME(msg *dns.Msg, qtype uint16, target string) {
+	var depth int
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			depth++
+		}
+	}
+	if depth > maxCNAMEDepth {
+		return
+	}
+	if dnsRecord, ok := t.lookupRecord(strings.TrimSuffix(target, ".")); ok {
+		t.answer(msg, qtype, target, dnsRecord)
+		return
+	}
+	if !t.options.FlattenCNAME || t.options.OfflineMode || len(t.upstreams) == 0 {
+		return
+	}
+	upstreamServer := sliceutil.PickRandom(t.upstreams)
+	req := &dns.Msg{}
+	req.SetQuestion(target, qtype)
+	resp, err := t.exchange(req, upstreamServer)
+	if err != nil {
+		t.logger.Errorf("Could not flatten cname %s with upstream %s: %s\n", target, upstreamServer.address, err)
+		return
+	}
+	t.recordAnswers(resp)
+	msg.Answer = append(msg.Answer, resp.Answer...)
+}
+
+// ttl returns the record ttl, falling back to the configured default when unset
+func (t *TinyDNS) ttl(dnsRecord *DnsRecord) uint32 {
+	if dnsRecord.TTL != nil {
+		return *dnsRecord.TTL
+	}
+	if t.options.TTL > 0 {
+		return uint32(t.options.TTL.Seconds())
+	}
+	return defaultTTL
+}
+
+// negativeTTL returns the ttl of a negative answer from the SOA in its authority section
+func negativeTTL(msg *dns.Msg) (uint32, bool) {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl), true
+		}
+	}
+	return 0, false
+}
+
+// negativeSOA caps the ttl of the SOA served with a negative answer to its minimum (RFC 2308)
+func negativeSOA(soa *dns.SOA) *dns.SOA {
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return soa
+}
+
+// jitterTTL randomly shifts the ttl by up to ±percent to spread cache expirations
+func jitterTTL(ttl uint32, percent int) uint32 {
+	delta := int64(ttl) * int64(percent) / 100
+	if delta == 0 {
+		return ttl
+	}
+	return uint32(int64(ttl) + rand.Int63n(2*delta+1) - delta)
+}
+
+// lookupRecord looks up the in-memory records case-insensitively, answers
+// are built with the name from the question so the request casing is preserved
+func (t *TinyDNS) lookupRecord(domain string) (*DnsRecord, bool) {
+	dnsRecord, ok := t.options.DnsRecords[strings.ToLower(domain)]
+	// disabled records are kept in the configuration but never matched
+	if !ok || dnsRecord.Disabled {
+		return nil, false
+	}
+	return dnsRecord, true
+}
+
+func (t *TinyDNS) zoneReply(r *dns.Msg, domain string) (*dns.Msg, bool) {
+	if t.zones == nil {
+		return nil, false
+	}
+	return t.zones.reply(r, domain)
+}
+
+// lookupWildcard returns the closest wildcard record (*.zone) matching the domain,
+// falling back to the catch-all * record
+func (t *TinyDNS) lookupWildcard(domain string) (*DnsRecord, bool) {
+	name := dns.Fqdn(domain)
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if dnsRecord, ok := t.lookupRecord("*." + strings.TrimSuffix(name[off:], ".")); ok {
+			return dnsRecord, true
+		}
+	}
+	return t.lookupRecord("*")
+}
+
+func (t *TinyDNS) isAuthoritative(domain string) bool {
+	for _, zone := range t.options.AuthoritativeZones {
+		if dns.IsSubDomain(dns.Fqdn(zone), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TinyDNS) hasSubdomains(domain string) bool {
+	for name, dnsRecord := range t.options.DnsRecords {
+		if fqdn := dns.Fqdn(name); !dnsRecord.Disabled && !strings.EqualFold(fqdn, domain) && dns.IsSubDomain(domain, fqdn) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneSOA returns the SOA of the closest enclosing zone among the in-memory records
+func (t *TinyDNS) zoneSOA(domain string) *dns.SOA {
+	name := dns.Fqdn(domain)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		zone := name[off:]
+		if dnsRecord, ok := t.lookupRecord(strings.TrimSuffix(zone, ".")); ok && dnsRecord.SOA != nil {
+			return soaRecord(zone, t.ttl(dnsRecord), dnsRecord.SOA)
+		}
+	}
+	return nil
+}
+
+func soaRecord(zone string, ttl uint32, soa *SOARecord) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      dns.Fqdn(soa.Ns),
+		Mbox:    dns.Fqdn(soa.Mbox),
+		Serial:  soa.Serial,
+		Refresh: soa.Refresh,
+		Retry:   soa.Retry,
+		Expire:  soa.Expire,
+		Minttl:  soa.Minttl,
+	}
+}
+
+// additional returns the known address records of a target host,
+// looking first at the in-memory records and then at the cache
+func (t *TinyDNS) additional(host string) []dns.RR {
+	name := dns.Fqdn(host)
+	if dnsRecord, ok := t.lookupRecord(strings.TrimSuffix(name, ".")); ok {
+		return addressRecords(name, t.ttl(dnsRecord), dnsRecord)
+	}
+	if dnsRecordBytes, ok := t.hm.Get(strings.ToLower(name)); ok {
+		dnsRecord := &DnsRecord{}
+		if err := gob.NewDecoder(bytes.NewReader(dnsRecordBytes)).Decode(dnsRecord); err == nil {
+			return addressRecords(name, t.ttl(dnsRecord), dnsRecord)
+		}
+	}
+	return nil
+}
+
+// capAddresses limits the address records of an answer to MaxAnswers, picked at random
+// with the random answer order so that the served subset rotates between queries
+func (t *TinyDNS) capAddresses(rrs []dns.RR) []dns.RR {
+	if t.options.MaxAnswers <= 0 || len(rrs) <= t.options.MaxAnswers {
+		return rrs
+	}
+	if t.options.AnswerOrder == AnswerOrderRandom {
+		rand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+	}
+	return rrs[:t.options.MaxAnswers]
+}
+
+func addressRecords(domain string, ttl uint32, dnsRecord *DnsRecord) []dns.RR {
+	var rrs []dns.RR
+	for _, a := range dnsRecord.A {
+		rrs = append(rrs, &dns.A{
+			Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
 			A:   net.ParseIP(a),
 		})
 	}
 	for _, aaaa := range dnsRecord.AAAA {
-		msg.Answer = append(msg.Answer, &dns.AAAA{
-			Hdr:  dns.RR_Header{Name: domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		rrs = append(rrs, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: domain, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
 			AAAA: net.ParseIP(aaaa),
 		})
 	}
-	return &msg
+	return rrs
 }
 
 func (t *TinyDNS) Run() error {
-	return t.server.ListenAndServe()
+	if t.options.DoHAddress != "" {
+		t.dohServer = t.newDoHServer()
+		go t.runDoH()
+	}
+	t.logger.Infof("Listening on: %s:%s\n", t.options.Net, t.options.ListenAddress)
+	if t.options.Net == "doq" {
+		listener, err := quic.ListenAddr(t.options.ListenAddress, t.doqTLS, nil)
+		if err != nil {
+			return &BindError{Net: t.options.Net, Address: t.options.ListenAddress, Err: err}
+		}
+		t.doqListener = listener
+		return t.serveDoQ(listener)
+	}
+	if t.options.Interface != "" || t.options.ReusePort {
+		if err := t.listen(); err != nil {
+			return &BindError{Net: t.options.Net, Address: t.options.ListenAddress, Err: err}
+		}
+		return t.server.ActivateAndServe()
+	}
+	err := t.server.ListenAndServe()
+	if isListenError(err) {
+		return &BindError{Net: t.options.Net, Address: t.options.ListenAddress, Err: err}
+	}
+	return err
+}
+
+// listen creates the server socket with the configured socket options
+func (t *TinyDNS) listen() error {
+	var controls []func(network, address string, c syscall.RawConn) error
+	if t.options.Interface != "" {
+		controls = append(controls, bindToDevice(t.options.Interface))
+	}
+	if t.options.ReusePort {
+		controls = append(controls, reusePort)
+	}
+	listenConfig := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		for _, control := range controls {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+	switch t.options.Net {
+	case "tcp", "tcp4", "tcp6":
+		listener, err := listenConfig.Listen(context.Background(), t.options.Net, t.options.ListenAddress)
+		if err != nil {
+			return err
+		}
+		t.server.Listener = listener
+	default:
+		network := t.options.Net
+		if network == "" {
+			network = "udp"
+		}
+		conn, err := listenConfig.ListenPacket(context.Background(), network, t.options.ListenAddress)
+		if err != nil {
+			return err
+		}
+		t.server.PacketConn = conn
+	}
+	return nil
 }
 
 func (t *TinyDNS) Close() {
+	if t.dohServer != nil {
+		_ = t.dohServer.Close()
+	}
+	if t.doqListener != nil {
+		_ = t.doqListener.Close()
+	}
+	if t.zones != nil {
+		t.zones.close()
+	}
+	for _, upstreams := range [][]upstream{t.upstreams, t.reverseUpstreams} {
+		for _, upstream := range upstreams {
+			if upstream.pool != nil {
+				upstream.pool.close()
+			}
+		}
+	}
+	if t.shadowUpstream != nil && t.shadowUpstream.pool != nil {
+		t.shadowUpstream.pool.close()
+	}
+	if t.snapshotDone != nil {
+		close(t.snapshotDone)
+		// a periodic snapshot may still be scanning the cache
+		t.snapshotWG.Wait()
+	}
+	if t.options.CacheSnapshotFile != "" {
+		if err := t.saveSnapshot(t.options.CacheSnapshotFile); err != nil {
+			t.logger.Errorf("Could not save cache snapshot: %s\n", err)
+		}
+	}
 	t.hm.Close()
 }
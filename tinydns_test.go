@@ -0,0 +1,394 @@
+package tinydns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestForceTCP(t *testing.T) {
+	tdns, err := New(&Options{DnsRecords: map[string]*DnsRecord{
+		"tcp.example.com": {A: []string{"10.0.0.1"}, ForceTCP: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+
+	r := &dns.Msg{}
+	r.SetQuestion("tcp.example.com.", dns.TypeA)
+
+	udp := NewTestResponseWriter()
+	udp.SetRemoteAddr(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353})
+	tdns.ServeDNS(udp, r)
+	if len(udp.Msgs) != 1 {
+		t.Fatalf("expected 1 udp response, got %d", len(udp.Msgs))
+	}
+	if msg := udp.Msgs[0]; !msg.Truncated || len(msg.Answer) != 0 {
+		t.Fatalf("expected truncated udp response without answers, got %s", msg)
+	}
+
+	tcp := NewTestResponseWriter()
+	tdns.ServeDNS(tcp, r)
+	if len(tcp.Msgs) != 1 {
+		t.Fatalf("expected 1 tcp response, got %d", len(tcp.Msgs))
+	}
+	if msg := tcp.Msgs[0]; msg.Truncated || len(msg.Answer) != 1 {
+		t.Fatalf("expected full tcp response, got %s", msg)
+	}
+}
+
+// stubUpstream serves the handler over udp on a local port, counting the queries
+func stubUpstream(t *testing.T, handler dns.HandlerFunc) (string, *int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries int32
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        conn,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			atomic.AddInt32(&queries, 1)
+			handler(w, r)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return conn.LocalAddr().String(), &queries
+}
+
+func TestCacheCaseInsensitive(t *testing.T) {
+	address, queries := stubUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := &dns.Msg{}
+		msg.SetReply(r)
+		msg.Answer = append(msg.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 0, 0, 1),
+		})
+		_ = w.WriteMsg(msg)
+	})
+	tdns, err := New(&Options{UpstreamServers: []string{address}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+
+	for _, name := range []string{"EXAMPLE.com.", "example.com."} {
+		r := &dns.Msg{}
+		r.SetQuestion(name, dns.TypeA)
+		w := NewTestResponseWriter()
+		tdns.ServeDNS(w, r)
+		if len(w.Msgs) != 1 || len(w.Msgs[0].Answer) != 1 {
+			t.Fatalf("expected 1 answer for %s, got %v", name, w.Msgs)
+		}
+		if owner := w.Msgs[0].Answer[0].Header().Name; owner != name {
+			t.Fatalf("expected answer for %s, got %s", name, owner)
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 1 {
+		t.Fatalf("expected 1 upstream query, got %d", n)
+	}
+}
+
+func TestNSGlue(t *testing.T) {
+	tdns, err := New(&Options{DnsRecords: map[string]*DnsRecord{
+		"example.com":     {NS: []string{"ns1.example.com", "ns2.example.com", "ns.other.net"}},
+		"ns1.example.com": {A: []string{"10.0.0.1"}},
+		"ns2.example.com": {A: []string{"10.0.0.2"}, AAAA: []string{"2001:db8::2"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+
+	r := &dns.Msg{}
+	r.SetQuestion("example.com.", dns.TypeNS)
+	w := NewTestResponseWriter()
+	tdns.ServeDNS(w, r)
+	if len(w.Msgs) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(w.Msgs))
+	}
+	msg := w.Msgs[0]
+	if len(msg.Answer) != 3 {
+		t.Fatalf("expected 3 ns records, got %d", len(msg.Answer))
+	}
+	// only the configured name servers have glue
+	glue := make(map[string]int)
+	for _, rr := range msg.Extra {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			glue[rr.Header().Name]++
+		}
+	}
+	if glue["ns1.example.com."] != 1 || glue["ns2.example.com."] != 2 || len(glue) != 2 {
+		t.Fatalf("unexpected glue records: %v", msg.Extra)
+	}
+}
+
+func TestRecordNamesCaseInsensitive(t *testing.T) {
+	tdns, err := New(&Options{DnsRecords: map[string]*DnsRecord{
+		"Example.com": {A: []string{"10.0.0.1"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+
+	r := &dns.Msg{}
+	r.SetQuestion("example.COM.", dns.TypeA)
+	w := NewTestResponseWriter()
+	tdns.ServeDNS(w, r)
+	if len(w.Msgs) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(w.Msgs))
+	}
+	if msg := w.Msgs[0]; len(msg.Answer) != 1 || msg.Answer[0].Header().Name != "example.COM." {
+		t.Fatalf("expected the configured record with the query name, got %s", msg)
+	}
+
+	if _, err := New(&Options{DnsRecords: map[string]*DnsRecord{
+		"Example.com": {A: []string{"10.0.0.1"}},
+		"example.com": {A: []string{"10.0.0.2"}},
+	}}); err == nil {
+		t.Fatal("expected records differing only in case to be rejected")
+	}
+}
+
+func TestCatchAllCNAME(t *testing.T) {
+	if _, err := New(&Options{CatchAllCNAME: "sink..lab"}); err == nil {
+		t.Fatal("expected an invalid catch-all cname to be rejected")
+	}
+
+	tdns, err := New(&Options{CatchAllCNAME: "sink.lab", OfflineMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+
+	r := &dns.Msg{}
+	r.SetQuestion("unknown.example.com.", dns.TypeA)
+	w := NewTestResponseWriter()
+	tdns.ServeDNS(w, r)
+	if len(w.Msgs) != 1 || len(w.Msgs[0].Answer) != 1 || w.Msgs[0].Answer[0].(*dns.CNAME).Target != "sink.lab." {
+		t.Fatalf("expected a cname to the sink, got %v", w.Msgs)
+	}
+
+	r.Question[0].Qclass = dns.ClassCHAOS
+	w = NewTestResponseWriter()
+	tdns.ServeDNS(w, r)
+	if len(w.Msgs) != 1 || len(w.Msgs[0].Answer) != 0 {
+		t.Fatalf("expected no cname for a chaos query, got %v", w.Msgs)
+	}
+}
+
+// sizeLimitedWriter fails to write responses larger than size, as a udp socket would
+type sizeLimitedWriter struct {
+	*TestResponseWriter
+	size int
+}
+
+func (w *sizeLimitedWriter) WriteMsg(msg *dns.Msg) error {
+	buf, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	if len(buf) > w.size {
+		return errors.New("message too large")
+	}
+	return w.TestResponseWriter.WriteMsg(msg)
+}
+
+func TestTruncateUDP(t *testing.T) {
+	var addresses []string
+	for i := 0; i < 60; i++ {
+		addresses = append(addresses, fmt.Sprintf("10.0.0.%d", i+1))
+	}
+	for _, compress := range []bool{false, true} {
+		for _, maxUDPSize := range []int{0, 600} {
+			tdns, err := New(&Options{
+				DnsRecords: map[string]*DnsRecord{"example.com": {A: addresses}},
+				Compress:   compress,
+				MaxUDPSize: maxUDPSize,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := &dns.Msg{}
+			r.SetQuestion("example.com.", dns.TypeA)
+			// without MaxUDPSize the oversized response is retried within the 512 bytes default
+			size := dns.MinMsgSize
+			if maxUDPSize > 0 {
+				size = maxUDPSize
+			}
+			w := &sizeLimitedWriter{TestResponseWriter: NewTestResponseWriter(), size: 4096}
+			if maxUDPSize == 0 {
+				w.size = size
+			}
+			w.SetRemoteAddr(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353})
+			tdns.ServeDNS(w, r)
+			tdns.Close()
+			if len(w.Msgs) != 1 {
+				t.Fatalf("compress=%v max=%d: expected 1 response, got %d", compress, maxUDPSize, len(w.Msgs))
+			}
+			msg := w.Msgs[0]
+			buf, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buf) > size || !msg.Truncated || len(msg.Answer) == 0 || msg.Compress != compress {
+				t.Fatalf("compress=%v max=%d: expected a truncated response of at most %d bytes, got %d bytes with %d answers",
+					compress, maxUDPSize, size, len(buf), len(msg.Answer))
+			}
+		}
+	}
+}
+
+func TestMaxAnswers(t *testing.T) {
+	tdns, err := New(&Options{
+		DnsRecords: map[string]*DnsRecord{
+			"www.example.com": {CNAME: "lb.example.com"},
+			"lb.example.com":  {A: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		},
+		MaxAnswers: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+
+	r := &dns.Msg{}
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	w := NewTestResponseWriter()
+	tdns.ServeDNS(w, r)
+	if len(w.Msgs) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(w.Msgs))
+	}
+	msg := w.Msgs[0]
+	if len(msg.Answer) != 2 {
+		t.Fatalf("expected the cname and a single address, got %v", msg.Answer)
+	}
+	if _, ok := msg.Answer[0].(*dns.CNAME); !ok {
+		t.Fatalf("expected the cname first, got %v", msg.Answer[0])
+	}
+	if _, ok := msg.Answer[1].(*dns.A); !ok {
+		t.Fatalf("expected an address after the cname, got %v", msg.Answer[1])
+	}
+}
+
+func TestCacheNegativeAnswer(t *testing.T) {
+	var records int32
+	address, queries := stubUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := &dns.Msg{}
+		msg.SetReply(r)
+		// the name gets records after its first query
+		if atomic.AddInt32(&records, 1) > 1 {
+			msg.Answer = append(msg.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(10, 0, 0, 1),
+			})
+		} else {
+			msg.Ns = append(msg.Ns, &dns.SOA{
+				Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns:     "ns1.example.com.",
+				Mbox:   "hostmaster.example.com.",
+				Minttl: 1,
+			})
+		}
+		_ = w.WriteMsg(msg)
+	})
+	tdns, err := New(&Options{UpstreamServers: []string{address}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+
+	query := func() *dns.Msg {
+		r := &dns.Msg{}
+		r.SetQuestion("new.example.com.", dns.TypeA)
+		w := NewTestResponseWriter()
+		tdns.ServeDNS(w, r)
+		if len(w.Msgs) != 1 {
+			t.Fatalf("expected 1 response, got %d", len(w.Msgs))
+		}
+		return w.Msgs[0]
+	}
+	for i := 0; i < 2; i++ {
+		msg := query()
+		if len(msg.Answer) != 0 || len(msg.Ns) != 1 || msg.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Fatalf("expected NODATA with the upstream SOA, got %s", msg)
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 1 {
+		t.Fatalf("expected the negative answer to be cached, got %d upstream queries", n)
+	}
+
+	// the negative ttl is the SOA minimum
+	time.Sleep(1100 * time.Millisecond)
+	if msg := query(); len(msg.Answer) != 1 {
+		t.Fatalf("expected the records added upstream once the negative answer expired, got %s", msg)
+	}
+	if n := atomic.LoadInt32(queries); n != 2 {
+		t.Fatalf("expected 2 upstream queries, got %d", n)
+	}
+}
+
+func TestRecordsAddedAfterNew(t *testing.T) {
+	dnsRecords := map[string]*DnsRecord{"Example.com": {A: []string{"10.0.0.1"}}}
+	tdns, err := New(&Options{DnsRecords: dnsRecords})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+	dnsRecords["added.example.com"] = &DnsRecord{A: []string{"10.0.0.2"}}
+
+	for _, name := range []string{"EXAMPLE.com.", "added.example.com."} {
+		r := &dns.Msg{}
+		r.SetQuestion(name, dns.TypeA)
+		w := NewTestResponseWriter()
+		tdns.ServeDNS(w, r)
+		if len(w.Msgs) != 1 || len(w.Msgs[0].Answer) != 1 {
+			t.Fatalf("expected 1 answer for %s, got %v", name, w.Msgs)
+		}
+	}
+}
+
+// recordingLogger keeps the formatted error messages
+type recordingLogger struct {
+	errors []string
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+func TestErrorsCarryQueryID(t *testing.T) {
+	address, _ := stubUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		// never answered, so that the forward times out
+	})
+	logger := &recordingLogger{}
+	tdns, err := New(&Options{UpstreamServers: []string{address}, UpstreamTimeout: 100 * time.Millisecond, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+	var id string
+	tdns.OnServeDns = func(info Info) { id = info.ID }
+
+	r := &dns.Msg{}
+	r.SetQuestion("example.com.", dns.TypeA)
+	tdns.ServeDNS(NewTestResponseWriter(), r)
+	if len(logger.errors) == 0 || !strings.HasPrefix(logger.errors[0], "["+id+"] ") {
+		t.Fatalf("expected the failed forward to be logged with the query id %s, got %v", id, logger.errors)
+	}
+}
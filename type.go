@@ -1,6 +1,113 @@
 package tinydns
 
 type DnsRecord struct {
-	A    []string
-	AAAA []string
+	A     []string
+	AAAA  []string
+	TXT   []string
+	MX    []MXRecord
+	SRV   []SRVRecord
+	NS    []string
+	NAPTR []NAPTRRecord
+	URI   []URIRecord
+	SOA   *SOARecord
+	CNAME string
+	// ANY is the canned answer to ANY queries, each entry being a type and its value (eg. "TXT hello")
+	ANY []string
+	// TTL is nil when unset, an explicit zero is served as is
+	TTL *uint32
+	// Class of the record (IN, CH or HS), only matched by queries in the same class, IN by default
+	Class string
+	// Rcode forces the response code (NXDOMAIN, REFUSED, SERVFAIL or NOTIMP) with no answers
+	Rcode string
+	// Views override the record for clients within their CIDR (split-horizon)
+	Views []View
+	// Combine answers with all the configured types when the queried type is one of them
+	Combine bool
+	// Exec answers with the output of the command, where {name} and {type} are substituted
+	// with the query ones, each line being a type and its value (eg. "A 1.2.3.4")
+	Exec string
+	// Compress overrides the server compression of the responses when set
+	Compress *bool
+	// AA, RA, AD and TC override the response flags when set
+	AA *bool
+	RA *bool
+	AD *bool
+	TC *bool
+	// Disabled keeps the record in the configuration without ever matching it
+	Disabled bool
+	// Template computes the address of names matched by a wildcard record from their first label,
+	// where {ip} is the dashed address (eg. ip-{ip} answers ip-10-0-0-1.example.com with 10.0.0.1)
+	Template string
+	// ForceTCP answers udp queries truncated, so that only tcp queries get the records
+	ForceTCP bool
+	// RequireEDNS answers FORMERR to queries without an OPT record
+	RequireEDNS bool
+	// Weighted answers A and AAAA queries with a single address of the family, picked at random
+	// in proportion to the weights (eg. 90 for the stable address and 10 for the canary)
+	Weighted []WeightedAddress
+}
+
+type WeightedAddress struct {
+	Address string
+	Weight  uint
+}
+
+type View struct {
+	CIDR   string
+	Record *DnsRecord
+}
+
+// ReverseZone answers PTR queries for addresses within CIDR by rendering Template,
+// where {ip} is replaced with the dashed address
+type ReverseZone struct {
+	CIDR     string
+	Template string
+	// SOA makes the zone authoritative, NS and SOA are served at its in-addr.arpa or ip6.arpa apex
+	SOA *SOARecord
+	NS  []string
+}
+
+// SyntheticZone answers the names generated from Pattern, where {n} is an index below Count,
+// with the address at the same offset from BaseIP (eg. host-{n}.test answers host-5.test with 10.0.0.5 from 10.0.0.0)
+type SyntheticZone struct {
+	Pattern string
+	Count   uint64
+	BaseIP  string
+}
+
+type MXRecord struct {
+	Preference uint16
+	Host       string
+}
+
+type SRVRecord struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+type NAPTRRecord struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Service     string
+	Regexp      string
+	Replacement string
+}
+
+type URIRecord struct {
+	Priority uint16
+	Weight   uint16
+	Target   string
+}
+
+type SOARecord struct {
+	Ns      string
+	Mbox    string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minttl  uint32
 }
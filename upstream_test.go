@@ -0,0 +1,59 @@
+package tinydns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTruncatedUpstreamRetriedOverTCP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// udp responses are truncated, tcp ones carry the full answer
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := &dns.Msg{}
+		msg.SetReply(r)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			msg.Truncated = true
+		} else {
+			for i := 0; i < 100; i++ {
+				msg.Answer = append(msg.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(10, 0, 0, byte(i)),
+				})
+			}
+		}
+		_ = w.WriteMsg(msg)
+	})
+	for _, server := range []*dns.Server{{PacketConn: conn, Handler: handler}, {Listener: listener, Handler: handler}} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go func(server *dns.Server) { _ = server.ActivateAndServe() }(server)
+		<-started
+		defer func(server *dns.Server) { _ = server.Shutdown() }(server)
+	}
+
+	tdns, err := New(&Options{UpstreamServers: []string{conn.LocalAddr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdns.Close()
+
+	r := &dns.Msg{}
+	r.SetQuestion("large.example.com.", dns.TypeA)
+	w := NewTestResponseWriter()
+	tdns.ServeDNS(w, r)
+	if len(w.Msgs) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(w.Msgs))
+	}
+	if msg := w.Msgs[0]; msg.Truncated || len(msg.Answer) != 100 {
+		t.Fatalf("expected the full answer, got %d records truncated=%v", len(msg.Answer), msg.Truncated)
+	}
+}
@@ -0,0 +1,119 @@
+package tinydns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+	sliceutil "github.com/projectdiscovery/utils/slice"
+)
+
+func validateRecords(dnsRecords map[string]*DnsRecord) error {
+	for domain, dnsRecord := range dnsRecords {
+		if err := validateRecord(dnsRecord); err != nil {
+			return &InvalidRecordError{Domain: domain, Err: err}
+		}
+	}
+	return nil
+}
+
+// normalizeRecords lowercases the names of the records in place so that they are matched
+// case-insensitively, the map staying shared with the caller
+func normalizeRecords(dnsRecords map[string]*DnsRecord) error {
+	domains := make([]string, 0, len(dnsRecords))
+	for domain := range dnsRecords {
+		domains = append(domains, domain)
+	}
+	for _, domain := range domains {
+		name := strings.ToLower(domain)
+		if name == domain {
+			continue
+		}
+		if _, ok := dnsRecords[name]; ok {
+			return &InvalidRecordError{Domain: domain, Err: errors.New("duplicate of a record differing only in case")}
+		}
+		dnsRecords[name] = dnsRecords[domain]
+		delete(dnsRecords, domain)
+	}
+	return nil
+}
+
+var allowedRcodes = []string{"NXDOMAIN", "REFUSED", "SERVFAIL", "NOTIMP"}
+
+var allowedClasses = []string{"IN", "CH", "HS"}
+
+func validateRecord(dnsRecord *DnsRecord) error {
+	if dnsRecord.Rcode != "" && !sliceutil.Contains(allowedRcodes, dnsRecord.Rcode) {
+		return fmt.Errorf("invalid rcode %q, allowed values are %s", dnsRecord.Rcode, strings.Join(allowedRcodes, ", "))
+	}
+	if dnsRecord.Class != "" && !sliceutil.Contains(allowedClasses, strings.ToUpper(dnsRecord.Class)) {
+		return fmt.Errorf("invalid class %q, allowed values are %s", dnsRecord.Class, strings.Join(allowedClasses, ", "))
+	}
+	// a cname can't coexist with other records (RFC 2181)
+	if dnsRecord.CNAME != "" && (len(dnsRecord.A) > 0 || len(dnsRecord.AAAA) > 0 || len(dnsRecord.TXT) > 0 ||
+		len(dnsRecord.MX) > 0 || len(dnsRecord.SRV) > 0 || len(dnsRecord.NS) > 0 || len(dnsRecord.NAPTR) > 0 ||
+		len(dnsRecord.URI) > 0 || len(dnsRecord.ANY) > 0 || len(dnsRecord.Weighted) > 0 || dnsRecord.SOA != nil) {
+		return fmt.Errorf("cname %s can't coexist with other records", dnsRecord.CNAME)
+	}
+	for _, naptr := range dnsRecord.NAPTR {
+		for _, flag := range naptr.Flags {
+			if !isAlphaNumeric(flag) {
+				return fmt.Errorf("naptr flags must be alphanumeric: %q", naptr.Flags)
+			}
+		}
+		replacement := naptr.Replacement
+		if replacement == "" {
+			replacement = "."
+		}
+		if _, ok := dns.IsDomainName(replacement); !ok {
+			return fmt.Errorf("invalid naptr replacement: %q", naptr.Replacement)
+		}
+		// regexp and replacement are mutually exclusive (RFC 3403)
+		if naptr.Regexp != "" && replacement != "." {
+			return fmt.Errorf("naptr regexp and replacement can't be both set")
+		}
+	}
+	for _, view := range dnsRecord.Views {
+		if _, _, err := net.ParseCIDR(view.CIDR); err != nil {
+			return fmt.Errorf("invalid view cidr: %w", err)
+		}
+		if view.Record == nil {
+			return fmt.Errorf("missing record for view %s", view.CIDR)
+		}
+		if err := validateRecord(view.Record); err != nil {
+			return fmt.Errorf("invalid record for view %s: %w", view.CIDR, err)
+		}
+	}
+	for _, weighted := range dnsRecord.Weighted {
+		if net.ParseIP(weighted.Address) == nil {
+			return fmt.Errorf("invalid weighted address: %q", weighted.Address)
+		}
+		if weighted.Weight == 0 {
+			return fmt.Errorf("weight of %s must be positive", weighted.Address)
+		}
+	}
+	if dnsRecord.Exec != "" && strings.TrimSpace(dnsRecord.Exec) == "" {
+		return fmt.Errorf("empty exec command")
+	}
+	for _, value := range dnsRecord.ANY {
+		if _, err := anyRecord("example.com.", defaultTTL, value); err != nil {
+			return fmt.Errorf("invalid any record %q: %w", value, err)
+		}
+	}
+	if dnsRecord.Template != "" && strings.Count(dnsRecord.Template, templateIP) != 1 {
+		return fmt.Errorf("template must contain %s once: %q", templateIP, dnsRecord.Template)
+	}
+	for _, uri := range dnsRecord.URI {
+		if _, err := url.Parse(uri.Target); err != nil || strings.TrimSpace(uri.Target) == "" {
+			return fmt.Errorf("invalid uri target: %q", uri.Target)
+		}
+	}
+	return nil
+}
+
+func isAlphaNumeric(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
@@ -0,0 +1,36 @@
+package tinydns
+
+import (
+	"math/rand"
+	"net"
+)
+
+// pickWeighted returns an address of the family at random in proportion to its weight,
+// or an empty string when no address of the family is weighted
+func pickWeighted(weighted []WeightedAddress, ipv6 bool) string {
+	var total int64
+	for _, address := range weighted {
+		if isIPv6(address.Address) == ipv6 {
+			total += int64(address.Weight)
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	n := rand.Int63n(total)
+	for _, address := range weighted {
+		if isIPv6(address.Address) != ipv6 {
+			continue
+		}
+		if n < int64(address.Weight) {
+			return address.Address
+		}
+		n -= int64(address.Weight)
+	}
+	return ""
+}
+
+func isIPv6(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && ip.To4() == nil
+}
@@ -0,0 +1,212 @@
+package tinydns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
+)
+
+var zoneFileExtensions = []string{".zone", ".db"}
+
+// zoneStore holds the records loaded from the zone files of a directory
+type zoneStore struct {
+	dir string
+	// reloads build new zones aside and swap them in, readers never block nor see partial zones
+	zones   atomic.Pointer[zoneSet]
+	watcher *fsnotify.Watcher
+}
+
+type zoneSet struct {
+	records map[string][]dns.RR
+	soa     map[string]*dns.SOA
+}
+
+func newZoneStore(dir string) (*zoneStore, error) {
+	zs := &zoneStore{dir: dir}
+	if err := zs.load(); err != nil {
+		return nil, err
+	}
+	return zs, nil
+}
+
+// load parses all the zone files, the origin of each zone is its file name (eg. example.com.zone)
+func (zs *zoneStore) load() error {
+	records := make(map[string][]dns.RR)
+	soa := make(map[string]*dns.SOA)
+	entries, err := os.ReadDir(zs.dir)
+	if err != nil {
+		return fmt.Errorf("could not read zone directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isZoneFile(entry.Name()) {
+			continue
+		}
+		origin := dns.Fqdn(strings.ToLower(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))))
+		if err := parseZoneFile(filepath.Join(zs.dir, entry.Name()), origin, records, soa); err != nil {
+			return err
+		}
+	}
+	for name, rrs := range records {
+		if err := checkCNAMECoexistence(name, rrs); err != nil {
+			return err
+		}
+	}
+
+	zs.zones.Store(&zoneSet{records: records, soa: soa})
+	return nil
+}
+
+func parseZoneFile(path, origin string, records map[string][]dns.RR, soa map[string]*dns.SOA) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open zone file: %w", err)
+	}
+	defer file.Close()
+
+	zp := dns.NewZoneParser(file, origin, path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		// a name has at most one cname (RFC 1034)
+		if rr.Header().Rrtype == dns.TypeCNAME && hasRRType(records[name], dns.TypeCNAME) {
+			return fmt.Errorf("multiple cnames for %s in zone file %s", name, path)
+		}
+		records[name] = append(records[name], rr)
+		if record, ok := rr.(*dns.SOA); ok {
+			soa[name] = record
+		}
+		// empty non-terminals exist without records
+		for off, end := dns.NextLabel(name, 0); !end && dns.IsSubDomain(origin, name[off:]); off, end = dns.NextLabel(name, off) {
+			if _, ok := records[name[off:]]; !ok {
+				records[name[off:]] = nil
+			}
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return fmt.Errorf("could not parse zone file: %w", err)
+	}
+	return nil
+}
+
+// checkCNAMECoexistence rejects names with a cname and other records besides DNSSEC ones (RFC 2181)
+func checkCNAMECoexistence(name string, rrs []dns.RR) error {
+	if !hasRRType(rrs, dns.TypeCNAME) {
+		return nil
+	}
+	for _, rr := range rrs {
+		switch rrtype := rr.Header().Rrtype; rrtype {
+		case dns.TypeCNAME, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			return fmt.Errorf("cname for %s can't coexist with %s records", name, dns.TypeToString[rrtype])
+		}
+	}
+	return nil
+}
+
+func hasRRType(rrs []dns.RR, rrtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+func isZoneFile(name string) bool {
+	for _, extension := range zoneFileExtensions {
+		if strings.HasSuffix(name, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// reply answers from the closest loaded zone enclosing the domain
+func (zs *zoneStore) reply(r *dns.Msg, domain string) (*dns.Msg, bool) {
+	zones := zs.zones.Load()
+
+	name := strings.ToLower(domain)
+	var origin string
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := zones.soa[name[off:]]; ok {
+			origin = name[off:]
+			break
+		}
+	}
+	if origin == "" {
+		return nil, false
+	}
+
+	msg := dns.Msg{}
+	msg.SetReply(r)
+	msg.Authoritative = true
+	rrs, exists := zones.records[name]
+	qtype := r.Question[0].Qtype
+	for _, rr := range rrs {
+		if rrtype := rr.Header().Rrtype; rrtype == qtype || rrtype == dns.TypeCNAME {
+			answer := dns.Copy(rr)
+			// keep the query casing
+			answer.Header().Name = domain
+			msg.Answer = append(msg.Answer, answer)
+		}
+	}
+	if len(msg.Answer) == 0 {
+		if !exists {
+			msg.Rcode = dns.RcodeNameError
+		}
+		msg.Ns = append(msg.Ns, negativeSOA(dns.Copy(zones.soa[origin]).(*dns.SOA)))
+	}
+	return &msg, true
+}
+
+// watch reloads the zones when files change, a failed reload keeps the previous zones
+func (zs *zoneStore) watch(logger Logger) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(zs.dir); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+	zs.watcher = watcher
+
+	go func() {
+		// editors write files in several steps, changes are debounced
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if isZoneFile(event.Name) {
+					reload = time.After(500 * time.Millisecond)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Errorf("Could not watch zone directory: %s\n", err)
+			case <-reload:
+				if err := zs.load(); err != nil {
+					logger.Errorf("Could not reload zones: %s\n", err)
+				} else {
+					logger.Infof("Reloaded zones from %s\n", zs.dir)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (zs *zoneStore) close() {
+	if zs.watcher != nil {
+		_ = zs.watcher.Close()
+	}
+}